@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRangeChunkSize limits the length of a single copy_file_range call,
+// the context is checked between the calls.
+const copyRangeChunkSize = 64 * 1024 * 1024
+
+// copyFileRange copies the region [offset, size) between the same offsets of the files with copy_file_range.
+// If the kernel or the filesystems don't support it, the rest of the region is copied in userspace.
+// Returns true if the whole region was copied by the kernel.
+func copyFileRange(ctx context.Context, dst, src *os.File, offset, size int64) (bool, error) {
+	for offset < size {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		n := size - offset
+		if n > copyRangeChunkSize {
+			n = copyRangeChunkSize
+		}
+
+		srcOffset, dstOffset := offset, offset
+		copied, err := unix.CopyFileRange(int(src.Fd()), &srcOffset, int(dst.Fd()), &dstOffset, int(n), 0)
+		switch {
+		case errors.Is(err, unix.EINTR):
+			continue
+		case errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) ||
+			errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EPERM):
+			return false, copyUserspace(ctx, dst, src, offset, size)
+		case err != nil:
+			return false, &os.SyscallError{Syscall: "copy_file_range", Err: err}
+		case copied == 0:
+			// Some filesystems report an empty file instead of an error
+			if offset == 0 {
+				return false, copyUserspace(ctx, dst, src, offset, size)
+			}
+			return false, io.ErrUnexpectedEOF
+		}
+
+		offset += int64(copied)
+	}
+	return true, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// copyFileRange copies the region [offset, size) between the same offsets of the files.
+// copy_file_range is available only on Linux, so the region is copied in userspace.
+func copyFileRange(ctx context.Context, dst, src *os.File, offset, size int64) (bool, error) {
+	return false, copyUserspace(ctx, dst, src, offset, size)
+}
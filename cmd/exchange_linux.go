@@ -0,0 +1,22 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangeFiles atomically exchanges two paths with renameat2(RENAME_EXCHANGE).
+func exchangeFiles(firstName, secondName string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, firstName, unix.AT_FDCWD, secondName, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+		return fmt.Errorf("%w: %s", ErrExchangeNotSupported, err)
+	} else if err != nil {
+		return &os.LinkError{Op: "renameat2", Old: firstName, New: secondName, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// exchangeFiles is supported on Linux only.
+func exchangeFiles(_, _ string) error {
+	return ErrExchangeNotSupported
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the number of bytes available to an unprivileged user on the filesystem of the path.
+func freeSpace(path string) (int64, error) {
+	var stats unix.Statfs_t
+	if err := unix.Statfs(path, &stats); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return int64(stats.Bavail) * stats.Bsize, nil
+}
+
+// sameDevice reports whether the files are located on the same filesystem.
+func sameDevice(a, b os.FileInfo) bool {
+	aStats, aOk := a.Sys().(*syscall.Stat_t)
+	bStats, bOk := b.Sys().(*syscall.Stat_t)
+	return !aOk || !bOk || aStats.Dev == bStats.Dev
+}
+
+// dirWritable checks that files can be created, renamed and removed in the directory.
+func dirWritable(dir string) error {
+	if err := unix.Access(dir, unix.W_OK|unix.X_OK); err != nil {
+		return &os.PathError{Op: "access", Path: dir, Err: err}
+	}
+	return nil
+}
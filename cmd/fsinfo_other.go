@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errFreeSpaceNotSupported = errors.New("not supported on this platform")
+
+// freeSpace is supported on Linux only.
+func freeSpace(_ string) (int64, error) {
+	return 0, errFreeSpaceNotSupported
+}
+
+// sameDevice is supported on Linux only, the files are considered to be on the same filesystem.
+func sameDevice(_, _ os.FileInfo) bool {
+	return true
+}
+
+// dirWritable is supported on Linux only, the directory is considered to be writable.
+func dirWritable(_ string) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// watchDir is supported on Linux only.
+func watchDir(_ context.Context, _ string, _ chan<- dirEvent) error {
+	return ErrWatchNotSupported
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"TestTask/pkg/file_system"
+)
+
+const (
+	journalFileName      = ".swap.journal"
+	journalCopyBlockSize = 64 * 1024
+	// Progress is persisted to the journal after every journalCheckpointSize copied bytes.
+	journalCheckpointSize = 4 * 1024 * 1024
+)
+
+// Journal states.
+// In the prepare state the backups are being written and the data files are untouched,
+// so an interrupted swap is rolled back. In the commit state the backups are durable
+// and the data files are being overwritten, so an interrupted swap is rolled forward.
+// In the rollback state the swap has failed and the data files are being restored from the backups,
+// so an interrupted rollback is finished.
+const (
+	journalStatePrepare  = "prepare"
+	journalStateCommit   = "commit"
+	journalStateRollback = "rollback"
+)
+
+// Journal modes.
+// In the copy mode the data files are overwritten in place and the backups keep the original content.
+// In the rename mode the directory entries of two files are swapped, the backup of the first entry
+// is its temporary name.
+const (
+	journalModeCopy   = "copy"
+	journalModeRename = "rename"
+)
+
+var (
+	ErrSwapInProgress    = errors.New("another swap journal exists in the directory, recovery is required")
+	ErrJournalCorrupted  = errors.New("swap journal is corrupted")
+	ErrJournalBadEntries = errors.New("swap journal must contain at least 2 files")
+)
+
+// swapJournal is a write-ahead journal of a swap.
+// It is stored next to the data files and removed after the swap is finished.
+type swapJournal struct {
+	fs  file_system.FS
+	dir string
+
+	Mode    string         `json:"mode"`
+	State   string         `json:"state"`
+	Entries []journalEntry `json:"entries"`
+}
+
+// journalEntry describes one file overwritten by the swap.
+// Paths are relative to the journal directory.
+type journalEntry struct {
+	Name    string `json:"name"`    // Data file
+	Size    int64  `json:"size"`    // Original size of the data file
+	Source  int    `json:"source"`  // Index of the entry whose original content the file receives
+	Backup  string `json:"backup"`  // Copy of the original content
+	Written int64  `json:"written"` // Number of bytes of the new content that are known to be durable
+	Done    bool   `json:"done"`
+	// SHA-256 of the original content, the files that receive it are verified in the copy mode
+	SHA256 []byte `json:"sha256,omitempty"`
+}
+
+// SwapTwoFilesJournaled swaps two files like SwapTwoFiles, but records the intent, the original sizes
+// and the progress in a journal, so an interrupted swap can be finished by RecoverSwap.
+// If the swap fails, both files are restored from the backups, so no undo files are written.
+func SwapTwoFilesJournaled(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string, readBlockSize int, writeBlockSize int) error {
+	if readBlockSize < 1 || writeBlockSize < 1 {
+		return ErrInvalidBlockSize
+	}
+
+	// The files stay locked by the readers while the backups are written and restored
+	firstFileReader, secondFileReader, err := openFileReaders(fsys, logger, path, firstName, secondName)
+	if err != nil {
+		return err
+	}
+	defer firstFileReader.Close()
+	defer secondFileReader.Close()
+
+	j, err := beginJournal(ctx, fsys, filepath.Dir(path+firstName), []string{path + firstName, path + secondName}, []int{1, 0})
+	if err != nil {
+		return err
+	}
+
+	err = swapFileReaders(ctx, fsys, logger, firstFileReader, secondFileReader, readBlockSize, writeBlockSize, false)
+	if err == nil {
+		if err = firstFileReader.Sync(); err == nil {
+			err = secondFileReader.Sync()
+		}
+	}
+	if err != nil {
+		if rbErr := j.rollBack(); rbErr != nil {
+			// The journal stays in the rollback state, so the rollback will be finished on the next start
+			return fmt.Errorf("%w (rollback failed: %s)", err, rbErr)
+		}
+		return err
+	}
+
+	return j.discard()
+}
+
+// RecoverSwap finishes or cancels a swap interrupted in the dir directory.
+// Returns true if there was an interrupted swap.
+// If the context is canceled, the journal is kept and the recovery continues on the next call.
+func RecoverSwap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, dir string) (bool, error) {
+	j, err := loadJournal(fsys, dir)
+	if err != nil {
+		return false, err
+	}
+	if j == nil {
+		// Backups may be left if the process stopped right after the journal was removed
+		return false, removeJournalBackups(fsys, dir)
+	}
+
+	// Before the commit the files are not modified yet, so the swap is discarded
+	logger.Info("recovering an interrupted swap", "dir", dir, "state", j.State)
+	switch j.State {
+	case journalStateCommit:
+		err = j.rollForward(ctx)
+		if j.Mode == journalModeRename && errors.Is(err, syscall.EXDEV) {
+			// Nothing is moved, the swap that can't be finished is discarded instead of being retried forever
+			logger.Warn("the files are on different filesystems, the interrupted swap is discarded", "dir", dir, "error", err)
+			return true, j.discard()
+		}
+		if err != nil {
+			return true, err
+		}
+	case journalStateRollback:
+		return true, j.rollBack()
+	}
+
+	return true, j.discard()
+}
+
+// RecoverSwaps calls RecoverSwap for the root directory and every subdirectory, whatever the selection options are,
+// so the swaps interrupted in the runs with other options are recovered too. Returns the number of interrupted swaps.
+func RecoverSwaps(ctx context.Context, fsys file_system.FS, logger *slog.Logger, root string, opts SelectOptions) (int, error) {
+	var count int
+	err := walkDirs(ctx, fsys, logger, root, recoveryOptions(opts), func(dir string) error {
+		recovered, err := RecoverSwap(ctx, fsys, logger, filepath.Join(root, dir))
+		if recovered {
+			count++
+		}
+		return err
+	}, nil)
+	return count, err
+}
+
+// FindInterruptedSwaps returns the directories with interrupted swaps that RecoverSwaps would recover.
+// The files are not modified.
+func FindInterruptedSwaps(ctx context.Context, fsys file_system.FS, logger *slog.Logger, root string, opts SelectOptions) ([]string, error) {
+	var dirs []string
+	err := walkDirs(ctx, fsys, logger, root, recoveryOptions(opts), func(dir string) error {
+		_, err := fsys.Lstat(filepath.Join(root, dir, journalFileName))
+		if err == nil {
+			dirs = append(dirs, filepath.Join(root, dir))
+			return nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}, nil)
+	return dirs, err
+}
+
+// recoveryOptions returns the options of the scan for the journals: the whole tree under the root is scanned,
+// only following the symlinks and reporting the progress are taken from the selection options.
+func recoveryOptions(opts SelectOptions) SelectOptions {
+	return SelectOptions{
+		Recursive:      true,
+		FollowSymlinks: opts.FollowSymlinks,
+		Progress:       opts.Progress,
+	}
+}
+
+// beginJournal creates a journal and backups of the files.
+// names[i] receives the original content of names[sources[i]].
+// If the context is canceled while the backups are written, the journal is discarded.
+func beginJournal(ctx context.Context, fsys file_system.FS, dir string, names []string, sources []int) (*swapJournal, error) {
+	j, err := newJournal(fsys, dir, journalModeCopy, names, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = j.save(); err != nil {
+		return nil, err
+	}
+
+	progress := progressFromContext(ctx)
+	for i := range j.Entries {
+		entry := &j.Entries[i]
+		progress.addTotal(entry.Size)
+		if entry.SHA256, err = copyFile(ctx, j.fs, j.path(entry.Backup), j.path(entry.Name), entry.Size); err != nil {
+			_ = j.discard()
+			return nil, err
+		}
+	}
+	syncDir(j.fs, dir)
+
+	j.State = journalStateCommit
+	if err = j.save(); err != nil {
+		_ = j.discard()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// beginRenameJournal creates a journal of a swap of two directory entries.
+// The first file is moved to a temporary name, the second file takes its place
+// and the temporary file takes the place of the second one. Nothing is copied,
+// so the journal starts in the commit state.
+func beginRenameJournal(fsys file_system.FS, dir, firstName, secondName string) (*swapJournal, error) {
+	j, err := newJournal(fsys, dir, journalModeRename, []string{firstName, secondName}, []int{1, 0})
+	if err != nil {
+		return nil, err
+	}
+	j.Entries[1].Backup = ""
+
+	j.State = journalStateCommit
+	if err = j.save(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func newJournal(fsys file_system.FS, dir, mode string, names []string, sources []int) (*swapJournal, error) {
+	if len(names) < 2 || len(names) != len(sources) {
+		return nil, ErrJournalBadEntries
+	}
+
+	if _, err := fsys.Stat(filepath.Join(dir, journalFileName)); err == nil {
+		return nil, ErrSwapInProgress
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	j := &swapJournal{
+		fs:      fsys,
+		dir:     dir,
+		Mode:    mode,
+		State:   journalStatePrepare,
+		Entries: make([]journalEntry, len(names)),
+	}
+
+	for i, name := range names {
+		if sources[i] < 0 || sources[i] >= len(names) {
+			return nil, ErrJournalBadEntries
+		}
+
+		fileStats, err := fsys.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+
+		relName, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		j.Entries[i] = journalEntry{
+			Name:   relName,
+			Size:   fileStats.Size(),
+			Source: sources[i],
+			Backup: fmt.Sprintf("%s.%d.bak", journalFileName, i),
+		}
+	}
+
+	return j, nil
+}
+
+func loadJournal(fsys file_system.FS, dir string) (*swapJournal, error) {
+	data, err := file_system.ReadFile(fsys, filepath.Join(dir, journalFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	j := &swapJournal{fs: fsys, dir: dir}
+	if err = json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJournalCorrupted, err)
+	}
+
+	if len(j.Entries) < 2 || (j.State != journalStatePrepare && j.State != journalStateCommit && j.State != journalStateRollback) {
+		return nil, ErrJournalCorrupted
+	}
+	// The renames are never rolled back
+	if j.Mode == journalModeRename && j.State == journalStateRollback {
+		return nil, ErrJournalCorrupted
+	}
+	if j.Mode != journalModeCopy && (j.Mode != journalModeRename || len(j.Entries) != 2) {
+		return nil, ErrJournalCorrupted
+	}
+	for _, entry := range j.Entries {
+		if entry.Source < 0 || entry.Source >= len(j.Entries) {
+			return nil, ErrJournalCorrupted
+		}
+	}
+
+	return j, nil
+}
+
+func (j *swapJournal) path(name string) string {
+	return filepath.Join(j.dir, name)
+}
+
+// save atomically replaces the journal file.
+func (j *swapJournal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	tmpName := j.path(journalFileName + ".tmp")
+
+	tmpFile, err := j.fs.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = tmpFile.Write(data); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = j.fs.Rename(tmpName, j.path(journalFileName))
+	}
+	if err != nil {
+		// The previous journal stays valid, the partially written one is not left in the directory
+		_ = j.fs.Remove(tmpName)
+		return err
+	}
+
+	syncDir(j.fs, j.dir)
+	return nil
+}
+
+// rollForward writes the original content of the source file into every unfinished entry.
+// Progress is saved, so an interrupted or canceled roll forward continues from the last checkpoint.
+func (j *swapJournal) rollForward(ctx context.Context) error {
+	if j.Mode == journalModeRename {
+		// Renames are not interrupted, the context is checked only before the first one
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return j.rollForwardRename()
+	}
+
+	progress := progressFromContext(ctx)
+	for i := range j.Entries {
+		entry := &j.Entries[i]
+		if entry.Done {
+			continue
+		}
+
+		source := j.Entries[entry.Source]
+		progress.addTotal(source.Size - entry.Written)
+		err := restoreFile(ctx, j.fs, j.path(entry.Name), j.path(source.Backup), entry.Written, source.Size, func(written int64) error {
+			entry.Written = written
+			return j.save()
+		})
+		if err != nil {
+			return err
+		}
+		// The journals written before the checksums were added have none
+		if source.SHA256 != nil {
+			if err = verifyChecksum(j.fs, j.path(entry.Name), source.SHA256); err != nil {
+				return err
+			}
+		}
+
+		entry.Written = source.Size
+		entry.Done = true
+		if err = j.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollForwardRename finishes the sequence of renames.
+// Each step checks what is already done, because the process may stop between a rename and a journal save.
+// If the second file can't take the place of the first one because they are on different filesystems,
+// the first rename is undone and the EXDEV error is returned, so an EXDEV error means that nothing is moved.
+func (j *swapJournal) rollForwardRename() error {
+	first, second := &j.Entries[0], &j.Entries[1]
+	firstName, secondName, tempName := j.path(first.Name), j.path(second.Name), j.path(first.Backup)
+
+	if !first.Done {
+		if _, err := j.fs.Stat(tempName); errors.Is(err, os.ErrNotExist) {
+			if err = j.fs.Rename(firstName, tempName); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := j.fs.Stat(firstName); errors.Is(err, os.ErrNotExist) {
+			if err = j.fs.Rename(secondName, firstName); errors.Is(err, syscall.EXDEV) {
+				if undoErr := j.fs.Rename(tempName, firstName); undoErr != nil {
+					return fmt.Errorf("%s (undo failed: %w)", err, undoErr)
+				}
+				syncDir(j.fs, j.dir)
+				return err
+			} else if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		syncDir(j.fs, j.dir)
+		first.Done = true
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	if !second.Done {
+		if _, err := j.fs.Stat(tempName); err == nil {
+			if err = j.fs.Rename(tempName, secondName); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		syncDir(j.fs, j.dir)
+		second.Done = true
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollBack restores the original content of every entry and removes the journal.
+// The rollback state is saved first, so an interrupted rollback is finished by RecoverSwap
+// instead of the failed swap being rolled forward. It is called after a failure or a cancellation,
+// so it is not canceled itself.
+func (j *swapJournal) rollBack() error {
+	if j.State != journalStateRollback {
+		j.State = journalStateRollback
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range j.Entries {
+		if err := restoreFile(context.Background(), j.fs, j.path(entry.Name), j.path(entry.Backup), 0, entry.Size, nil); err != nil {
+			return err
+		}
+	}
+	return j.discard()
+}
+
+// discard removes the journal and then the backups.
+// Removing the journal file is the commit point of the swap.
+func (j *swapJournal) discard() error {
+	if err := j.fs.Remove(j.path(journalFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	syncDir(j.fs, j.dir)
+	return removeJournalBackups(j.fs, j.dir)
+}
+
+func removeJournalBackups(fsys file_system.FS, dir string) error {
+	backups, err := file_system.Glob(fsys, dir, journalFileName+".*.bak")
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		if err = fsys.Remove(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile copies src[offset:size] into dst at the same offset, truncates dst to size and syncs it.
+func restoreFile(ctx context.Context, fsys file_system.FS, dstName, srcName string, offset, size int64, checkpoint func(written int64) error) error {
+	src, err := file_system.Open(fsys, srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fsys.OpenFile(dstName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err = copyRegion(ctx, dst, src, offset, size, checkpoint); err != nil {
+		return err
+	}
+	if err = dst.Truncate(size); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// copyFile creates dst with the first size bytes of src, syncs it and returns the SHA-256 of the copied bytes.
+func copyFile(ctx context.Context, fsys file_system.FS, dstName, srcName string, size int64) ([]byte, error) {
+	src, err := file_system.Open(fsys, srcName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	dst, err := fsys.OpenFile(dstName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+
+	// copyRegion reads the source sequentially, so the bytes are hashed in order
+	h := sha256.New()
+	if err = copyRegion(ctx, dst, &hashReaderAt{ReaderAt: src, hash: h}, 0, size, nil); err != nil {
+		return nil, err
+	}
+	if err = dst.Sync(); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// hashReaderAt writes the bytes read from the reader to the hash.
+type hashReaderAt struct {
+	io.ReaderAt
+	hash hash.Hash
+}
+
+func (r *hashReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// syncWriterAt is a file that can be written at an offset and flushed to the disk.
+type syncWriterAt interface {
+	io.WriterAt
+	Sync() error
+}
+
+// copyRegion copies src[offset:size] into dst at the same offset.
+// The data written before each checkpoint call is synced. The copy is stopped if the context is canceled.
+// The copied bytes are added to the progress of the context.
+func copyRegion(ctx context.Context, dst syncWriterAt, src io.ReaderAt, offset, size int64, checkpoint func(written int64) error) error {
+	buf := make([]byte, journalCopyBlockSize)
+	progress := progressFromContext(ctx)
+	var sinceCheckpoint int64
+
+	for offset < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+
+		m, err := src.ReadAt(buf[:n], offset)
+		if int64(m) < n {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		progress.addRead(n)
+
+		if _, err = dst.WriteAt(buf[:n], offset); err != nil {
+			return err
+		}
+		progress.addWritten(n)
+		offset += n
+		sinceCheckpoint += n
+
+		if checkpoint != nil && sinceCheckpoint >= journalCheckpointSize {
+			if err = dst.Sync(); err != nil {
+				return err
+			}
+			if err = checkpoint(offset); err != nil {
+				return err
+			}
+			sinceCheckpoint = 0
+		}
+	}
+	return nil
+}
+
+// syncDir makes renames and removals in the directory durable.
+// Not every platform allows to sync a directory, so it is done on a best-effort basis.
+func syncDir(fsys file_system.FS, dir string) {
+	d, err := file_system.Open(fsys, dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"TestTask/pkg/file_lock"
+	"TestTask/pkg/file_system"
+)
+
+var ErrSameFile = errors.New("the files are hard links to the same file")
+
+// lockFile takes the exclusive advisory lock of a file of the OS filesystem until the file is closed.
+// Files of the other filesystems are not shared with other processes and are not locked.
+func lockFile(file file_system.File) error {
+	if osFile, ok := file_system.OSFile(file); ok {
+		return file_lock.TryLock(osFile)
+	}
+	return nil
+}
+
+// lockFiles locks the files for the time of a swap that doesn't keep them open.
+// The locks are held by separate descriptors and are released by the returned function.
+// Returns ErrSameFile if two of the files are hard links to the same file, they would lock each other out.
+func lockFiles(fsys file_system.FS, names ...string) (func(), error) {
+	if err := checkDistinctFiles(fsys, names...); err != nil {
+		return nil, err
+	}
+
+	files := make([]file_system.File, 0, len(names))
+	unlock := func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}
+
+	for _, name := range names {
+		file, err := file_system.Open(fsys, name)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		files = append(files, file)
+
+		if err = lockFile(file); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// checkDistinctFiles returns ErrSameFile if any two of the files are hard links to the same file.
+func checkDistinctFiles(fsys file_system.FS, names ...string) error {
+	stats := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		fileStats, err := fsys.Stat(name)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < i; j++ {
+			if os.SameFile(stats[j], fileStats) {
+				return fmt.Errorf("%w: %s and %s", ErrSameFile, names[j], name)
+			}
+		}
+		stats[i] = fileStats
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var (
+	ErrUnknownLogLevel  = errors.New("unknown log level (debug, info, warn or error)")
+	ErrUnknownLogFormat = errors.New("unknown log format (text or json)")
+)
+
+// newLogger returns a logger that writes the records of the level and above to w in the format.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownLogLevel, level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case LogFormatText:
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownLogFormat, format)
+	}
+}
+
+// scanProgressLogger returns a progress callback for the directory scan that logs
+// the number of scanned entries not more often than once per interval.
+func scanProgressLogger(logger *slog.Logger, interval time.Duration) func(scanned int) {
+	lastReport := time.Now()
+	return func(scanned int) {
+		if time.Since(lastReport) >= interval {
+			logger.Info("scanning directories", "scanned", scanned)
+			lastReport = time.Now()
+		}
+	}
+}
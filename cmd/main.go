@@ -1,325 +1,671 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"regexp"
+	"os/signal"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"TestTask/internal/config"
+	"TestTask/pkg/file_lock"
 	"TestTask/pkg/file_reader"
+	"TestTask/pkg/file_system"
 )
 
 var (
-	ErrNoFiles        = errors.New("there are no files that fit the conditions ([-][0-9]*.log or [0-9]*.log)")
-	ErrNotEnoughFiles = errors.New("there are not enough files (at least 2) that match the conditions")
+	ErrChecksumMismatch = errors.New("the content of the file doesn't match the swapped content")
+	ErrInvalidBlockSize = errors.New("invalid block size")
+	ErrNotOSFilesystem  = errors.New("supported on the OS filesystem only")
 )
 
 // Реализовано чтение и запись по одному символу, однако такой подход крайне медленный.
 // Поэтому реализованы также буферизованные версии функций записи и чтения (используются для отладки).
 // Для чтения\записи по одному символу можно выставить значения readBlockSize \ writeBlockSize как единицу.
 func main() {
-	var configPath string
-	var allowNegativeNames bool
-	var readBlockSize, writeBlockSize int
+	var opts runOptions
 
-	flag.StringVar(&configPath, "config-path", "configs/config.yml", "Path to the config file")
-	flag.BoolVar(&allowNegativeNames, "neg", false, "Allow reading negative names")
-	flag.IntVar(&readBlockSize, "rbs", 1, "The number of bytes read at a time")
-	flag.IntVar(&writeBlockSize, "wbs", 1, "The number of bytes written at a time")
-	flag.Parse()
-
-	start := time.Now()
+	// The mode is the first argument, the flags follow it
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && (args[0] == CommandWatch || args[0] == CommandServe) {
+		command, args = args[0], args[1:]
+	}
 
-	cfg, err := config.NewConfig(configPath)
+	flag.StringVar(&opts.configPath, "config-path", "configs/config.yml", "Path to the config file")
+	flag.BoolVar(&opts.allowNegativeNames, "neg", false, "Allow reading negative names")
+	flag.BoolVar(&opts.allowDecimalNames, "dec", false, "Allow reading decimal and exponent-formatted names (3.14.log, 1e6.log)")
+	flag.IntVar(&opts.readBlockSize, "rbs", 1, "The number of bytes read at a time")
+	flag.IntVar(&opts.writeBlockSize, "wbs", 1, "The number of bytes written at a time")
+	flag.BoolVar(&opts.journal, "journal", false, "Keep a write-ahead journal, so an interrupted swap can be recovered (stream strategy)")
+	flag.BoolVar(&opts.rotate, "rotate", false, "Rotate the contents of all files instead of swapping min and max")
+	flag.StringVar(&opts.strategyName, "strategy", StrategyAuto, "Swap strategy: auto, exchange, rename, stream or zerocopy")
+	flag.StringVar(&opts.recursiveMode, "recursive", RecursiveOff, "Scan subdirectories: off, dir (a swap in every directory) or global (a single swap across the tree)")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "Print the planned swap, the estimated I/O and the warnings without modifying the files")
+	flag.StringVar(&opts.output, "output", OutputText, "Output format: text or json")
+	flag.StringVar(&opts.metadata, "metadata", "", "Permissions, owner, times and xattrs: keep (stay with the file name) or swap (move with the content), by default it depends on the strategy")
+	flag.DurationVar(&opts.lockWait, "lock-wait", 0, "How long to wait for another run to unlock the directory, 0 fails immediately, a negative value waits forever")
+	flag.DurationVar(&opts.timeout, "timeout", 0, "Cancel the run after the timeout (e.g. 30s, 5m), 0 means no timeout; in the watch mode it limits every swap")
+	flag.StringVar(&opts.watchPolicy, "watch-policy", WatchPolicyChange, "Watch mode: swap after any change of the files (change), a new file (new) or a new min or max file (pair)")
+	flag.DurationVar(&opts.debounce, "debounce", time.Second, "Watch mode: swap when the files didn't change for the interval")
+	flag.StringVar(&opts.listen, "listen", ":8080", "Serve mode: the address of the HTTP API and /metrics")
+	flag.StringVar(&opts.metricsListen, "metrics-listen", "", "Watch mode: the address of /metrics, empty disables it")
+	flag.StringVar(&opts.metricsFile, "metrics-file", "", "Write the metrics of the run to the file for the textfile collector (e.g. /var/lib/node_exporter/swap.prom)")
+	flag.StringVar(&opts.progress, "progress", ProgressAuto, "Progress of the swap: auto (bar if stdout is a terminal, otherwise events), bar, events (logged at the info level) or off")
+	logLevel := flag.String("log-level", "warn", "Log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", LogFormatText, "Log format: text or json")
+	_ = flag.CommandLine.Parse(args)
+
+	// Diagnostics are logged to stderr, the output of the run is printed to stdout
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
 	if err != nil {
-		fmt.Printf("cannot read config file: %s\n", err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitConfig)
 	}
 
-	var minName, maxName string
+	// SIGINT and SIGTERM cancel the run, a swap in progress is rolled back
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
-	minName, maxName, err = GetFileNamesWithMinMaxNameNum(cfg.PathToFiles, allowNegativeNames)
-	if err != nil {
-		fmt.Printf("GetFileNamesWithMinMaxNameNum: %s\n", err)
-		return
+	out := io.Writer(os.Stdout)
+	if opts.output == OutputJSON {
+		// The text is replaced by the result printed at the end
+		out = io.Discard
 	}
 
-	fmt.Printf("File with min value: [%s], File with max value: [%s].\n", minName, maxName)
+	printResult := func(result *RunResult) {
+		if opts.output == OutputJSON {
+			if err := writeRunResult(os.Stdout, result); err != nil {
+				logger.Error("cannot write the result", "error", err)
+			}
+		}
+	}
 
-	err = SwapTwoFiles(cfg.PathToFiles, minName, maxName, readBlockSize, writeBlockSize)
-	if err != nil {
-		fmt.Printf("Processing error: %s\n", err)
+	if command != "" {
+		// The watch and the API run until they are signaled, the errors of the swaps are reported and don't stop them
+		var resultErr *ResultError
+		if command == CommandWatch {
+			resultErr = watch(ctx, file_system.OS, logger, opts, out, printResult)
+		} else {
+			resultErr = serve(ctx, file_system.OS, logger, opts, out)
+		}
+		stop()
+		if resultErr != nil {
+			printResult(&RunResult{Groups: []ResultGroup{}, Error: resultErr})
+			logger.Error("cannot run the "+command+" mode", "code", resultErr.Code, "error", resultErr.Message)
+			os.Exit(resultErr.ExitCode)
+		}
 		return
 	}
-	fmt.Printf("The files was successfully swapped.\nExec time: %s\n", time.Now().Sub(start))
+
+	var metrics *runMetrics
+	if opts.metricsFile != "" {
+		metrics = newRunMetrics()
+	}
+
+	result := runWithTimeout(ctx, file_system.OS, logger, opts, out, metrics)
+	stop()
+
+	if metrics != nil {
+		if err := metrics.writeTextfile(opts.metricsFile); err != nil {
+			logger.Error("cannot write the metrics", "file", opts.metricsFile, "error", err)
+		}
+	}
+
+	printResult(result)
+	if result.Error != nil {
+		os.Exit(result.Error.ExitCode)
+	}
 }
 
-func GetFileNamesWithMinMaxNameNum(filesPath string, allowNegativeNames bool) (string, string, error) {
-	f, err := os.Open(filesPath)
+// runOptions are the command line flags.
+type runOptions struct {
+	configPath, strategyName, recursiveMode, output string
+	metadata                                        string
+	allowNegativeNames, allowDecimalNames, journal  bool
+	rotate, dryRun                                  bool
+	readBlockSize, writeBlockSize                   int
+	timeout, lockWait                               time.Duration
+
+	// Watch mode
+	watchPolicy   string
+	debounce      time.Duration
+	metricsListen string
+
+	// Serve mode
+	listen string
+
+	// The file for the textfile collector of a one-shot run
+	metricsFile string
+
+	// Progress mode, the empty mode is off
+	progress string
+}
+
+// lockFileName is the name of the lock file created in the directory from the config.
+const lockFileName = ".swap.lock"
+
+// run selects and swaps (or rotates) the files of the filesystem, prints the progress as text to out,
+// logs to the logger and returns the result. If the context is canceled, the swap in progress is rolled back
+// and the remaining groups are skipped.
+func run(ctx context.Context, fsys file_system.FS, logger *slog.Logger, opts runOptions, out io.Writer) *RunResult {
+	start := time.Now()
+	result := &RunResult{Operation: OperationSwap, DryRun: opts.dryRun, Groups: []ResultGroup{}}
+	if opts.rotate {
+		result.Operation = OperationRotate
+	}
+
+	logger = logger.With("operation", result.Operation)
+	logger.Info("run started", "config", opts.configPath, "strategy", opts.strategyName, "dry_run", opts.dryRun)
+
+	// The progress of the swaps is rendered until the end of the run
+	stopProgress := func() {}
+	var progress *swapProgress
+
+	fail := func(code string, format string, args ...interface{}) *RunResult {
+		stopProgress()
+		result.setTransferred(progress)
+		result.fail(code, fmt.Errorf(format, args...))
+		result.Duration = time.Since(start).Seconds()
+		fmt.Fprintln(out, result.Error.Message)
+		logger.Error("run failed", "code", code, "error", result.Error.Message)
+		return result
+	}
+
+	if opts.output != OutputText && opts.output != OutputJSON {
+		return fail(ErrorCodeConfig, "%w: %s", ErrUnknownOutput, opts.output)
+	}
+
+	cfg, err := config.NewConfig(opts.configPath)
 	if err != nil {
-		return "", "", err
+		return fail(ErrorCodeConfig, "cannot read config file: %w", err)
 	}
-	defer f.Close()
 
-	fileInfo, err := f.Readdir(-1)
+	strategy, err := NewSwapStrategy(opts.strategyName, opts.readBlockSize, opts.writeBlockSize, opts.journal)
 	if err != nil {
-		return "", "", err
+		return fail(ErrorCodeConfig, "NewSwapStrategy: %w", err)
+	}
+
+	recursiveMode := opts.recursiveMode
+	if recursiveMode != RecursiveOff && recursiveMode != RecursiveDir && recursiveMode != RecursiveGlobal {
+		return fail(ErrorCodeConfig, "%w: %s", ErrUnknownRecursiveMode, recursiveMode)
+	}
+
+	if opts.metadata != "" && opts.metadata != MetadataKeep && opts.metadata != MetadataSwap {
+		return fail(ErrorCodeConfig, "%w: %s", ErrUnknownMetadataMode, opts.metadata)
+	}
+
+	if opts.metadata != "" && !file_system.IsOS(fsys) {
+		return fail(ErrorCodeConfig, "the metadata mode is %w", ErrNotOSFilesystem)
 	}
 
-	var count int
-	var minName, maxName string
+	progressMode := opts.progress
+	switch progressMode {
+	case "":
+		progressMode = ProgressOff
+	case ProgressAuto:
+		progressMode = resolveProgressMode(progressMode, opts.output, os.Stdout)
+	case ProgressBar, ProgressEvents, ProgressOff:
+	default:
+		return fail(ErrorCodeConfig, "%w: %s", ErrUnknownProgressMode, opts.progress)
+	}
 
-	var numsReg *regexp.Regexp
-	if allowNegativeNames {
-		// If we accept extreme conditions, including negative numbers in the name
-		numsReg = regexp.MustCompile("^-?[0-9]+.log$")
+	selectOpts := newSelectOptions(opts, cfg, logger)
+
+	// Concurrent runs in the same directory are serialized. The dry run only warns about them: it doesn't create
+	// the lock file and doesn't hold the lock, so it doesn't block the other runs.
+	// Other filesystems than the OS one are not shared with other processes and are not locked.
+	lockName := filepath.Join(cfg.PathToFiles, lockFileName)
+	switch {
+	case !file_system.IsOS(fsys):
+	case opts.dryRun:
+		if err = file_lock.ProbeFile(lockName); err != nil {
+			logger.Warn("the directory is locked", "error", err)
+			fmt.Fprintf(out, "Warning: %s\n", err)
+			result.Warnings = append(result.Warnings, err.Error())
+		}
+	default:
+		lock, err := file_lock.LockFile(ctx, lockName, opts.lockWait)
+		if err != nil {
+			return fail(errorCode(err), "cannot lock the directory: %w", err)
+		}
+		defer lock.Unlock()
+		logger.Debug("directory locked", "lock", lockName)
+	}
+
+	// Finishing swaps interrupted by a crash
+	if opts.dryRun {
+		interrupted, err := FindInterruptedSwaps(ctx, fsys, logger, cfg.PathToFiles, selectOpts)
+		if err != nil {
+			return fail(errorCode(err), "FindInterruptedSwaps: %w", err)
+		}
+		for _, dir := range interrupted {
+			fmt.Fprintf(out, "Warning: an interrupted swap in %s will be recovered first, the plan may change\n", dir)
+		}
+		result.Interrupted = interrupted
 	} else {
-		// If the condition is: all names are not negative
-		numsReg = regexp.MustCompile("^[0-9]+.log$")
+		recovered, err := RecoverSwaps(ctx, fsys, logger, cfg.PathToFiles, selectOpts)
+		if err != nil {
+			return fail(errorCode(err), "RecoverSwaps: %w", err)
+		}
+		if recovered > 0 {
+			logger.Warn("interrupted swaps recovered", "count", recovered)
+			fmt.Fprintf(out, "Interrupted swaps were recovered: %d.\n", recovered)
+		}
+		result.Recovered = recovered
 	}
 
-	for _, file := range fileInfo {
-		if file.IsDir() {
-			continue
+	// The zerocopy swaps are not journaled, the files they left are reported
+	stages, err := FindSwapStages(ctx, fsys, logger, cfg.PathToFiles, selectOpts)
+	if err != nil {
+		return fail(errorCode(err), "FindSwapStages: %w", err)
+	}
+	for _, stage := range stages {
+		warning := fmt.Sprintf("%s is left by an interrupted zerocopy swap, it may hold the original content of a file in its directory", stage)
+		logger.Warn("a stage file of an interrupted swap is left", "file", stage)
+		fmt.Fprintf(out, "Warning: %s\n", warning)
+		result.Warnings = append(result.Warnings, warning)
+	}
+
+	// Every group is processed independently: the min and max files are swapped or all files are rotated
+	scanStart := time.Now()
+	scanOpts := selectOpts
+	scanOpts.Progress = func(scanned int) {
+		result.Scanned = scanned
+		selectOpts.Progress(scanned)
+	}
+	groups, err := selectGroups(ctx, fsys, logger, cfg.PathToFiles, opts, scanOpts)
+	result.ScanDuration = time.Since(scanStart).Seconds()
+	if err != nil {
+		return fail(errorCode(err), "%w", err)
+	}
+	logger.Info("files selected", "groups", len(groups), "scanned", result.Scanned, "scan_duration", time.Since(scanStart))
+
+	if opts.dryRun {
+		fmt.Fprintln(out, "Dry run, the files are not modified.")
+		for _, names := range groups {
+			var plan *SwapPlan
+			if opts.rotate {
+				plan, err = PlanRotation(fsys, cfg.PathToFiles, names)
+			} else {
+				plan, err = PlanSwap(fsys, strategy, cfg.PathToFiles, names[0], names[len(names)-1])
+			}
+			if err != nil {
+				return fail(errorCode(err), "Planning error: %w", err)
+			}
+			printSwapPlan(out, plan)
+			result.Groups = append(result.Groups, newPlannedGroup(plan))
 		}
+		result.Duration = time.Since(start).Seconds()
+		return result
+	}
 
-		fileName := file.Name()
-		if !numsReg.MatchString(fileName) {
-			continue
+	// The progress may be passed by the caller to poll it
+	progress = progressFromContext(ctx)
+	if progress == nil {
+		progress = newSwapProgress()
+		ctx = contextWithProgress(ctx, progress)
+	}
+	stopProgress = startProgressReporter(progress, progressMode, out, logger)
+
+	for _, names := range groups {
+		if !opts.rotate {
+			names = []string{names[0], names[len(names)-1]}
 		}
 
-		if minName == "" || maxName == "" {
-			minName = fileName
-			maxName = fileName
+		// Hard links to the same file are skipped, they would lock each other out
+		paths := make([]string, len(names))
+		for i, name := range names {
+			paths[i] = cfg.PathToFiles + name
+		}
+		if err = checkDistinctFiles(fsys, paths...); errors.Is(err, ErrSameFile) {
+			logger.Warn("files skipped", "error", err)
+			fmt.Fprintf(out, "Warning: %s, the files are skipped\n", err)
+			result.Warnings = append(result.Warnings, err.Error())
+			continue
+		} else if err != nil {
+			return fail(errorCode(err), "Processing error: %w", err)
 		}
 
-		if allowNegativeNames {
-			// If we accept extreme conditions, including negative numbers in the name
+		group, err := newResultGroup(fsys, cfg.PathToFiles, names)
+		if err != nil {
+			return fail(errorCode(err), "Processing error: %w", err)
+		}
+		result.Groups = append(result.Groups, group)
 
-			// Compare min name
-			switch {
-			case fileName[0] == '-' && minName[0] == '-':
-				if len(fileName) >= len(minName) && fileName > minName {
-					minName = fileName
-				}
-			case fileName[0] == '-':
-				minName = fileName
-			case minName[0] == '-':
-			default:
-				if len(fileName) < len(minName) || (len(fileName) == len(minName) && fileName < minName) {
-					minName = fileName
-				}
+		var metadata []*fileMetadata
+		if opts.metadata != "" {
+			if metadata, err = captureMetadata(cfg.PathToFiles, names); err != nil {
+				return fail(errorCode(err), "Processing error: %w", err)
 			}
+		}
 
-			// Compare max name
-			switch {
-			case fileName[0] == '-' && maxName[0] == '-':
-				if len(fileName) <= len(maxName) && fileName < maxName {
-					maxName = fileName
-				}
-			case fileName[0] == '-':
-			case maxName[0] == '-':
-				maxName = fileName
-			default:
-				if len(fileName) > len(maxName) || (len(fileName) == len(maxName) && fileName > maxName) {
-					maxName = fileName
-				}
-			}
+		logger.Info("processing files", "files", names)
+		groupStart := time.Now()
+
+		if opts.rotate {
+			fmt.Fprintf(out, "Files to rotate: %v.\n", names)
+			err = RotateFiles(ctx, fsys, cfg.PathToFiles, names)
 		} else {
-			// If the condition is: all names are not negative
-			if len(fileName) < len(minName) || (len(fileName) == len(minName) && fileName < minName) {
-				minName = fileName
-			} else if len(fileName) > len(maxName) || (len(fileName) == len(maxName) && fileName > maxName) {
-				maxName = fileName
+			fmt.Fprintf(out, "File with min value: [%s], File with max value: [%s].\n", names[0], names[1])
+			err = strategy.Swap(ctx, fsys, logger, cfg.PathToFiles, names[0], names[1])
+		}
+		if err != nil {
+			return fail(errorCode(err), "Processing error: %w", err)
+		}
+
+		if metadata != nil {
+			logger.Debug("restoring metadata", "mode", opts.metadata)
+			// The contents are already swapped, so the run succeeds with a warning
+			if err = restoreMetadata(opts.metadata, cfg.PathToFiles, names, metadata); err != nil {
+				logger.Warn("cannot restore the metadata", "files", names, "error", err)
+				fmt.Fprintf(out, "Warning: %s\n", err)
+				result.Warnings = append(result.Warnings, err.Error())
 			}
 		}
 
-		count++
+		if opts.output == OutputJSON {
+			if err = result.Groups[len(result.Groups)-1].computeChecksums(fsys, cfg.PathToFiles); err != nil {
+				return fail(errorCode(err), "Processing error: %w", err)
+			}
+		}
+		result.Bytes += result.Groups[len(result.Groups)-1].totalSize()
+		logger.Info("files processed", "files", names, "strategy", strategy.Name(), "duration", time.Since(groupStart))
 	}
 
-	if minName == "" || maxName == "" {
-		return "", "", ErrNoFiles
-	} else if minName == maxName {
-		return "", "", ErrNotEnoughFiles
+	stopProgress()
+	result.setTransferred(progress)
+	result.Duration = time.Since(start).Seconds()
+	logger.Info("run finished", "bytes", result.Bytes, "duration", time.Since(start))
+	if opts.rotate {
+		fmt.Fprintf(out, "The files was successfully rotated.\nExec time: %s\n", time.Now().Sub(start))
+		return result
 	}
-
-	return minName, maxName, nil
+	result.Strategy = strategy.Name()
+	fmt.Fprintf(out, "The files was successfully swapped.\nStrategy: %s\nExec time: %s\n", strategy.Name(), time.Now().Sub(start))
+	return result
 }
 
-// ByteRecordingToFileBuffered writes bytes received from chan to a file.
-// An optimized variant of the ByteRecordingToFile.
-// Reduces the number of file accesses (1.7s vs 1m 20s for files 16MB and 16 MB).
-// Buffers input.
-func ByteRecordingToFileBuffered(dstFile *os.File, bytesToWrite <-chan byte, writeBlockSize int, errCh chan error, wg *sync.WaitGroup) {
-	var chIndex int64
-	buf := make([]byte, writeBlockSize)
-	currSymbol := 0
-
-	for ch := range bytesToWrite {
-		// Checking errors from the second goroutine
-		select {
-		case err := <-errCh:
-			errCh <- err
-			wg.Done()
-			return
-		default:
-		}
-
-		//if currSymbol < writeBlockSize {
-		buf[currSymbol] = ch
-		currSymbol++
-		if currSymbol == writeBlockSize {
-			if _, err := dstFile.WriteAt(buf, chIndex); err != nil {
-				errCh <- err
-				wg.Done()
-				return
-			}
-			chIndex += int64(writeBlockSize)
-			currSymbol = 0
+// selectGroups returns the groups of the files processed independently.
+func selectGroups(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path string, opts runOptions, selectOpts SelectOptions) ([][]string, error) {
+	switch {
+	case opts.recursiveMode == RecursiveDir:
+		groups, err := GetFileNamesPerDirectory(ctx, fsys, logger, path, selectOpts)
+		if err != nil {
+			return nil, fmt.Errorf("GetFileNamesPerDirectory: %w", err)
+		}
+		return groups, nil
+	case opts.rotate:
+		names, err := GetSortedFileNames(ctx, fsys, logger, path, selectOpts)
+		if err != nil {
+			return nil, fmt.Errorf("GetSortedFileNames: %w", err)
+		}
+		return [][]string{names}, nil
+	default:
+		minName, maxName, err := GetFileNamesWithMinMaxNameNum(ctx, fsys, logger, path, selectOpts)
+		if err != nil {
+			return nil, fmt.Errorf("GetFileNamesWithMinMaxNameNum: %w", err)
 		}
+		return [][]string{{minName, maxName}}, nil
 	}
+}
 
-	if currSymbol > 0 && currSymbol < writeBlockSize {
-		shortBuf := buf[:currSymbol]
-		_, _ = dstFile.WriteAt(shortBuf, chIndex)
-		chIndex += int64(currSymbol)
+// newSelectOptions returns the conditions for the names of the files set by the flags and the config.
+// The progress of the scan is logged to the logger.
+func newSelectOptions(opts runOptions, cfg *config.Config, logger *slog.Logger) SelectOptions {
+	return SelectOptions{
+		AllowNegativeNames: opts.allowNegativeNames,
+		AllowDecimalNames:  opts.allowDecimalNames,
+		Pattern:            cfg.FilePattern,
+		Extensions:         cfg.Extensions,
+		CaseInsensitive:    cfg.CaseInsensitive,
+		Recursive:          opts.recursiveMode != RecursiveOff,
+		Include:            cfg.Include,
+		Exclude:            cfg.Exclude,
+		FollowSymlinks:     cfg.FollowSymlinks,
+		Progress:           scanProgressLogger(logger, time.Second),
 	}
+}
 
-	wg.Done()
+// printSwapPlan prints the files, the strategy, the estimated I/O and the warnings of the plan.
+func printSwapPlan(out io.Writer, plan *SwapPlan) {
+	for _, file := range plan.Files {
+		fmt.Fprintf(out, "File: [%s], size: %d bytes.\n", file.Name, file.Size)
+	}
+	fmt.Fprintf(out, "Strategy: %s\n", plan.Strategy)
+	fmt.Fprintf(out, "Estimated I/O: %d bytes read, %d bytes written.\n", plan.BytesRead, plan.BytesWritten)
+	fmt.Fprintf(out, "Additional space: %d bytes next to the files, %d bytes in the temporary directory.\n", plan.ExtraSpace, plan.TempSpace)
+	for _, warning := range plan.Warnings {
+		fmt.Fprintf(out, "Warning: %s\n", warning)
+	}
 }
 
 // ByteRecordingToFile writes bytes received from chan to a file.
-func ByteRecordingToFile(dstFile *os.File, bytesToWrite <-chan byte, errCh chan error, wg *sync.WaitGroup) {
+// Writing is stopped if the context is canceled.
+func ByteRecordingToFile(ctx context.Context, dstFile io.WriterAt, bytesToWrite <-chan byte) error {
 	var chIndex int64
 	buf := make([]byte, 1)
 
 	for ch := range bytesToWrite {
-		select {
-		case err := <-errCh:
-			errCh <- err
-			wg.Done()
-			return
-		default:
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
 		buf[0] = ch
 		if _, err := dstFile.WriteAt(buf, chIndex); err != nil {
-			errCh <- err
-			break
+			return err
 		}
 
 		chIndex++
 	}
-
-	wg.Done()
+	return nil
 }
 
-func SwapTwoFiles(path, firstName, secondName string, readBlockSize int, writeBlockSize int) error {
-	var firstFileReader, secondFileReader *file_reader.FileReader
-	var err error
+// SwapTwoFiles swaps the contents of two files of the filesystem.
+// If an error occurs or the context is canceled, both files are restored to their original contents and sizes.
+func SwapTwoFiles(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string, readBlockSize int, writeBlockSize int) error {
+	if readBlockSize < 1 || writeBlockSize < 1 {
+		return ErrInvalidBlockSize
+	}
 
-	firstFileReader, err = file_reader.NewFileReader(path+firstName, readBlockSize)
+	firstFileReader, secondFileReader, err := openFileReaders(fsys, logger, path, firstName, secondName)
 	if err != nil {
 		return err
 	}
 	defer firstFileReader.Close()
+	defer secondFileReader.Close()
+
+	return swapFileReaders(ctx, fsys, logger, firstFileReader, secondFileReader, readBlockSize, writeBlockSize, true)
+}
+
+// openFileReaders opens two files for the swap. The files are locked until the readers are closed,
+// so the files must be distinct: two hard links to the same file would lock each other out.
+func openFileReaders(fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) (*file_reader.FileReader, *file_reader.FileReader, error) {
+	if err := checkDistinctFiles(fsys, path+firstName, path+secondName); err != nil {
+		return nil, nil, err
+	}
 
-	secondFileReader, err = file_reader.NewFileReader(path+secondName, readBlockSize)
+	firstFileReader, err := openFileReader(fsys, logger, path+firstName)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer secondFileReader.Close()
+
+	secondFileReader, err := openFileReader(fsys, logger, path+secondName)
+	if err != nil {
+		_ = firstFileReader.Close()
+		return nil, nil, err
+	}
+
+	return firstFileReader, secondFileReader, nil
+}
+
+// openFileReader opens the file and locks it until the reader is closed.
+func openFileReader(fsys file_system.FS, logger *slog.Logger, name string) (*file_reader.FileReader, error) {
+	reader, err := file_reader.OpenFileReader(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(reader.File()); err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	reader.SetLogger(logger)
+	return reader, nil
+}
+
+// swapFileReaders swaps the contents of the files opened by the readers. If undo is set, the overwritten data
+// is saved to temporary undo files and the files are restored on failure, otherwise the caller restores them.
+func swapFileReaders(ctx context.Context, fsys file_system.FS, logger *slog.Logger, firstFileReader, secondFileReader *file_reader.FileReader, readBlockSize int, writeBlockSize int, undo bool) error {
+	var firstSnapshot, secondSnapshot *fileSnapshot
+	var err error
+
+	logger.Debug("swap started", "first", firstFileReader.Name(), "second", secondFileReader.Name(),
+		"read_block_size", readBlockSize, "write_block_size", writeBlockSize)
+
+	if undo {
+		firstSnapshot, err = newFileSnapshot(fsys, firstFileReader)
+		if err != nil {
+			return err
+		}
+		defer firstSnapshot.Close()
+
+		secondSnapshot, err = newFileSnapshot(fsys, secondFileReader)
+		if err != nil {
+			return err
+		}
+		defer secondSnapshot.Close()
+	}
+	firstSize := firstFileReader.Size()
+
+	// Every file receives the content of the other one
+	progress := progressFromContext(ctx)
+	progress.addTotal(firstFileReader.Size() + secondFileReader.Size())
+
+	// The first error cancels the other goroutines
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	swapErr := &swapError{cancel: cancel}
 
 	recordWg := &sync.WaitGroup{}
-	errCh := make(chan error, 1)
-	symbolsFromFirstFile, symbolsFromSecondFile := make(chan byte), make(chan byte)
+	pool := newBlockPool(readBlockSize)
+	blocksFromFirstFile := make(chan *[]byte, pipelineDepth)
+	blocksFromSecondFile := make(chan *[]byte, pipelineDepth)
 
 	// Start recording processes
 
 	recordWg.Add(1)
-	//go ByteRecordingToFile(firstFileReader.GetFile(), symbolsFromSecondFile, errCh, recordWg)
-	go ByteRecordingToFileBuffered(firstFileReader.GetFile(), symbolsFromSecondFile, writeBlockSize, errCh, recordWg)
+	go func() {
+		defer recordWg.Done()
+		swapErr.Set(BlockRecordingToFile(ctx, logger.With("file", firstFileReader.Name()), firstFileReader, firstSnapshot, blocksFromSecondFile, pool, writeBlockSize))
+	}()
 
 	recordWg.Add(1)
-	//go ByteRecordingToFile(secondFileReader.GetFile(), symbolsFromFirstFile, errCh, recordWg)
-	go ByteRecordingToFileBuffered(secondFileReader.GetFile(), symbolsFromFirstFile, writeBlockSize, errCh, recordWg)
-
-	var firstL, secondL int
-	var firstText, secondText []byte
-
+	go func() {
+		defer recordWg.Done()
+		swapErr.Set(BlockRecordingToFile(ctx, logger.With("file", secondFileReader.Name()), secondFileReader, secondSnapshot, blocksFromFirstFile, pool, writeBlockSize))
+	}()
+
+	readers := []*file_reader.FileReader{firstFileReader, secondFileReader}
+	// Blocks of the first file are written to the second one and vice versa
+	pipes := []chan<- *[]byte{blocksFromFirstFile, blocksFromSecondFile}
+	blocks := make([]*[]byte, len(readers))
+
+	// Blocks of both files at the same offset are read before any of them is sent to be written,
+	// so a file is never overwritten before it is read
 runtimeError:
 	for !firstFileReader.EOF() || !secondFileReader.EOF() {
-		if !firstFileReader.EOF() {
-			firstL, firstText, err = firstFileReader.ReadBytes()
-			if firstFileReader.EOF() {
-				close(symbolsFromFirstFile)
+		for i, reader := range readers {
+			blocks[i] = nil
+			if reader.EOF() {
+				continue
 			}
-		}
 
-		if !secondFileReader.EOF() {
-			secondL, secondText, err = secondFileReader.ReadBytes()
-			if secondFileReader.EOF() {
-				close(symbolsFromSecondFile)
+			block := pool.Get()
+			n, err := reader.ReadContext(ctx, *block)
+			if err != nil && !errors.Is(err, io.EOF) {
+				pool.Put(block)
+				swapErr.Set(err)
+				break runtimeError
+			}
+			if n == 0 {
+				pool.Put(block)
+				continue
 			}
+
+			progress.addRead(int64(n))
+			*block = (*block)[:n]
+			blocks[i] = block
 		}
 
-		sendBytesWg := &sync.WaitGroup{}
-
-		if !firstFileReader.EOF() {
-			sendBytesWg.Add(1)
-			go func(err *error) {
-				for i := 0; i < firstL; i++ {
-					select {
-					case *err = <-errCh:
-						errCh <- *err
-						sendBytesWg.Done()
-						return
-					default:
-						symbolsFromFirstFile <- firstText[i]
-					}
-				}
-				sendBytesWg.Done()
-			}(&err)
-		}
-
-		if !secondFileReader.EOF() {
-			for i := 0; i < secondL; i++ {
-				select {
-				case err = <-errCh:
-					errCh <- err
-					break runtimeError
-				default:
-					symbolsFromSecondFile <- secondText[i]
-				}
+		for i, block := range blocks {
+			if block == nil {
+				continue
 			}
-		}
-		sendBytesWg.Wait()
 
-		// Getting an error if it exists
-		select {
-		case err = <-errCh:
-			break runtimeError
-		default:
+			select {
+			case <-ctx.Done():
+				swapErr.Set(ctx.Err())
+				break runtimeError
+			case pipes[i] <- block:
+			}
 		}
 	}
 
+	// On error the loop is interrupted before the end of the files, the writers are stopped by closing the channels
+	close(blocksFromFirstFile)
+	close(blocksFromSecondFile)
 	recordWg.Wait()
 
-	// Truncate the remaining part
-	_ = os.Truncate(firstFileReader.GetFile().Name(), secondFileReader.Size())
-	_ = os.Truncate(secondFileReader.GetFile().Name(), firstFileReader.Size())
-
 	// Getting an error if it exists
-	select {
-	case err = <-errCh:
-		if err != nil {
-			return err
+	if err = swapErr.Err(); err == nil {
+		// Truncate the remaining part
+		if err = firstFileReader.Truncate(secondFileReader.Size()); err == nil {
+			err = secondFileReader.Truncate(firstSize)
 		}
-	default:
+
+		// Every file must contain exactly the original content of the other one
+		if err == nil {
+			err = verifyChecksum(fsys, firstFileReader.Name(), secondFileReader.Checksum())
+		}
+		if err == nil {
+			err = verifyChecksum(fsys, secondFileReader.Name(), firstFileReader.Checksum())
+		}
+	}
+
+	if err != nil && !undo {
+		logger.Warn("swap failed", "error", err)
+		return err
+	}
+	if err != nil {
+		logger.Warn("swap failed, restoring the files", "error", err)
+		if rbErr := firstSnapshot.Restore(); rbErr != nil {
+			logger.Error("cannot restore the file", "file", firstFileReader.Name(), "error", rbErr)
+			return fmt.Errorf("%w (rollback failed: %s)", err, rbErr)
+		}
+		if rbErr := secondSnapshot.Restore(); rbErr != nil {
+			logger.Error("cannot restore the file", "file", secondFileReader.Name(), "error", rbErr)
+			return fmt.Errorf("%w (rollback failed: %s)", err, rbErr)
+		}
+		return err
+	}
+	logger.Debug("swap finished, checksums verified")
+	return nil
+}
+
+// verifyChecksum returns ErrChecksumMismatch if the SHA-256 of the file content isn't equal to the expected one.
+func verifyChecksum(fsys file_system.FS, name string, expected []byte) error {
+	actual, err := fileSHA256(fsys, name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(actual, expected) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, name)
 	}
 	return nil
 }
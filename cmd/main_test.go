@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
-	"sync"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"TestTask/internal/logging"
+	"TestTask/pkg/file_lock"
 	"TestTask/pkg/file_reader"
+	"TestTask/pkg/file_system"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,6 +38,7 @@ func TestGetFileNamesWithMinMaxNameLen(t *testing.T) {
 		Name               string
 		TestFolder         string
 		AllowNegativeNames bool
+		AllowDecimalNames  bool
 
 		ExpectedMinName string
 		ExpectedMaxName string
@@ -196,11 +212,36 @@ func TestGetFileNamesWithMinMaxNameLen(t *testing.T) {
 			MustError:          true,
 			ExpectedError:      nil,
 		},
+		{
+			Name:               "Leading zeros: allow negative true",
+			TestFolder:         "TC_LeadingZeros",
+			AllowNegativeNames: true,
+			ExpectedMinName:    "-007.log",
+			ExpectedMaxName:    "6.log",
+			ExpectedError:      nil,
+		},
+		{
+			Name:               "Leading zeros: allow negative false",
+			TestFolder:         "TC_LeadingZeros",
+			AllowNegativeNames: false,
+			ExpectedMinName:    "0005.log",
+			ExpectedMaxName:    "6.log",
+			ExpectedError:      nil,
+		},
+		{
+			Name:               "Decimal names: allow decimal true",
+			TestFolder:         "TC_DecimalNames",
+			AllowNegativeNames: true,
+			AllowDecimalNames:  true,
+			ExpectedMinName:    "-2.5.log",
+			ExpectedMaxName:    "1e6.log",
+			ExpectedError:      nil,
+		},
 	}
 
 	for _, tc := range tcs {
 		t.Run(tc.Name, func(t *testing.T) {
-			min, max, err := GetFileNamesWithMinMaxNameNum(TestFolderPath+NamesTestFolderPath+tc.TestFolder, tc.AllowNegativeNames)
+			min, max, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, TestFolderPath+NamesTestFolderPath+tc.TestFolder, SelectOptions{AllowNegativeNames: tc.AllowNegativeNames, AllowDecimalNames: tc.AllowDecimalNames})
 			assert.ErrorIs(t, err, tc.ExpectedError)
 			assert.Equal(t, min, tc.ExpectedMinName)
 			assert.Equal(t, max, tc.ExpectedMaxName)
@@ -208,6 +249,143 @@ func TestGetFileNamesWithMinMaxNameLen(t *testing.T) {
 	}
 }
 
+func TestGetSortedFileNames(t *testing.T) {
+	type TestCase struct {
+		Name               string
+		TestFolder         string
+		AllowNegativeNames bool
+		AllowDecimalNames  bool
+
+		ExpectedNames []string
+		ExpectedError error
+	}
+
+	tcs := []TestCase{
+		{
+			Name:               "Leading zeros and negative zero",
+			TestFolder:         "TC_LeadingZeros",
+			AllowNegativeNames: true,
+			ExpectedNames:      []string{"-007.log", "-0.log", "0005.log", "6.log"},
+		},
+		{
+			Name:               "Long file names",
+			TestFolder:         "TC_LongNames",
+			AllowNegativeNames: true,
+			ExpectedNames: []string{
+				"-12345678901011121314151617181920.log",
+				"12345678901011121314151617181919.log",
+				"12345678901011121314151617181920.log",
+			},
+		},
+		{
+			Name:               "Same file names",
+			TestFolder:         "TC_SameLength",
+			AllowNegativeNames: true,
+			ExpectedNames:      []string{"-24.log", "-10.log", "100.log", "500.log"},
+		},
+		{
+			Name:               "Decimal names: allow decimal true",
+			TestFolder:         "TC_DecimalNames",
+			AllowNegativeNames: true,
+			AllowDecimalNames:  true,
+			ExpectedNames:      []string{"-2.5.log", "-2.log", "1e-3.log", "3.log", "3.14.log", "1e6.log"},
+		},
+		{
+			Name:               "Decimal names: allow decimal false",
+			TestFolder:         "TC_DecimalNames",
+			AllowNegativeNames: true,
+			ExpectedNames:      []string{"-2.log", "3.log"},
+		},
+		{
+			Name:               "Folder with 1 positive file",
+			TestFolder:         "TC1_1Positive",
+			AllowNegativeNames: true,
+			ExpectedError:      ErrNotEnoughFiles,
+		},
+		{
+			Name:               "Folder with 2 negative files: allow negative false",
+			TestFolder:         "TC2_2Negative",
+			AllowNegativeNames: false,
+			ExpectedError:      ErrNoFiles,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			names, err := GetSortedFileNames(context.Background(), file_system.OS, logging.Discard, TestFolderPath+NamesTestFolderPath+tc.TestFolder, SelectOptions{AllowNegativeNames: tc.AllowNegativeNames, AllowDecimalNames: tc.AllowDecimalNames})
+			assert.ErrorIs(t, err, tc.ExpectedError)
+			assert.Equal(t, tc.ExpectedNames, names)
+		})
+	}
+}
+
+func TestGetSortedFileNamesPattern(t *testing.T) {
+	type TestCase struct {
+		Name    string
+		Options SelectOptions
+
+		ExpectedNames   []string
+		ExpectedError   error
+		ExpectedMessage string
+	}
+
+	tcs := []TestCase{
+		{
+			Name:          "Pattern: case sensitive",
+			Options:       SelectOptions{AllowNegativeNames: true, Pattern: `app-(?P<num>-?\d+)\.txt`},
+			ExpectedNames: []string{"app-5.txt", "app-10.txt"},
+		},
+		{
+			Name:          "Pattern: case insensitive",
+			Options:       SelectOptions{AllowNegativeNames: true, Pattern: `app-(?P<num>-?\d+)\.txt`, CaseInsensitive: true},
+			ExpectedNames: []string{"app--3.TXT", "app-5.txt", "app-10.txt"},
+		},
+		{
+			Name:          "Pattern with extensions",
+			Options:       SelectOptions{Pattern: `app-(?P<num>.+)`, Extensions: []string{".txt"}},
+			ExpectedNames: []string{"app-5.txt", "app-10.txt"},
+		},
+		{
+			Name:          "Extensions: case insensitive",
+			Options:       SelectOptions{Extensions: []string{".log"}, CaseInsensitive: true},
+			ExpectedNames: []string{"7.log", "8.LOG"},
+		},
+		{
+			Name:          "Extensions: case sensitive",
+			Options:       SelectOptions{Extensions: []string{".log"}},
+			ExpectedError: ErrNotEnoughFiles,
+		},
+		{
+			Name:          "No files",
+			Options:       SelectOptions{Pattern: `app-(?P<num>\d+)`, Extensions: []string{".log", ".csv"}, CaseInsensitive: true},
+			ExpectedError: ErrNoFiles,
+			ExpectedMessage: "there are no files that fit the conditions " +
+				`(app-(?P<num>\d+) with .log or .csv, non-negative numbers, case-insensitive)`,
+		},
+		{
+			Name:          "Pattern without the num group",
+			Options:       SelectOptions{Pattern: `app-(-?\d+)\.txt`},
+			ExpectedError: ErrInvalidPattern,
+		},
+		{
+			Name:          "Invalid pattern",
+			Options:       SelectOptions{Pattern: `app-(?P<num>\d+`},
+			ExpectedError: ErrInvalidPattern,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			names, err := GetSortedFileNames(context.Background(), file_system.OS, logging.Discard, TestFolderPath+NamesTestFolderPath+"TC_Pattern", tc.Options)
+			assert.ErrorIs(t, err, tc.ExpectedError)
+			assert.Equal(t, tc.ExpectedNames, names)
+			if tc.ExpectedMessage != "" {
+				assert.EqualError(t, err, tc.ExpectedMessage)
+			}
+		})
+	}
+}
+
 func generateNewLogData(size int) []byte {
 	newFileValue := make([]byte, size)
 
@@ -277,7 +455,7 @@ func TestByteRecordingToFile(t *testing.T) {
 
 	_ = newTestFile.Close()
 
-	startReader, err := file_reader.NewFileReader(testFileName, 64)
+	startReader, err := file_reader.OpenFileReader(file_system.OS, testFileName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -292,12 +470,14 @@ func TestByteRecordingToFile(t *testing.T) {
 
 	bytes := make(chan byte, 1)
 	errCh := make(chan error, 1)
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go ByteRecordingToFile(outFile, bytes, errCh, wg)
+	go func() {
+		errCh <- ByteRecordingToFile(context.Background(), outFile, bytes)
+	}()
 
+	readBuf := make([]byte, 64)
 	for !startReader.EOF() {
-		n, batch, err := startReader.ReadBytes()
+		n, err := startReader.Read(readBuf)
+		batch := readBuf
 		if errors.Is(err, io.EOF) {
 			if n == 0 {
 				break
@@ -323,9 +503,9 @@ func TestByteRecordingToFile(t *testing.T) {
 	}
 
 	close(bytes)
-	wg.Wait()
+	assert.NoError(t, <-errCh)
 
-	outReader, err := file_reader.NewFileReader(outFileName, 64)
+	outReader, err := file_reader.OpenFileReader(file_system.OS, outFileName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -336,20 +516,23 @@ func TestByteRecordingToFile(t *testing.T) {
 		fmt.Println("Конечный файл:", outReader.Size())
 	}
 
-	startReader.SetOffset(0)
+	if _, err = startReader.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
 
+	sourceBuf, destBuf := make([]byte, 64), make([]byte, 64)
 	allEOF := false
 	for !allEOF {
 		allEOF = false
 
-		n, sourceText, err := startReader.ReadBytes()
+		n, err := startReader.Read(sourceBuf)
 		if errors.Is(err, io.EOF) {
 			allEOF = true
 		} else if err != nil {
 			t.Fatal(err)
 		}
 
-		m, destText, err := outReader.ReadBytes()
+		m, err := outReader.Read(destBuf)
 		if errors.Is(err, io.EOF) {
 			allEOF = allEOF == true
 		} else if err != nil {
@@ -360,7 +543,7 @@ func TestByteRecordingToFile(t *testing.T) {
 			t.Fatal("n != m:", n, "!=", m)
 		}
 
-		assert.Equal(t, sourceText, destText)
+		assert.Equal(t, sourceBuf[:n], destBuf[:m])
 	}
 
 	fmt.Println("End of test")
@@ -369,7 +552,7 @@ func TestByteRecordingToFile(t *testing.T) {
 	_ = os.Remove(outFileName)
 }
 
-func TestByteRecordingToFileBuffered(t *testing.T) {
+func TestBlockRecordingToFile(t *testing.T) {
 	testFileName := TestFolderPath + "testCaseBRTFB.log"
 	outFileName := TestFolderPath + "outCaseBRTFB.log"
 
@@ -390,7 +573,7 @@ func TestByteRecordingToFileBuffered(t *testing.T) {
 
 	_ = newTestFile.Close()
 
-	startReader, err := file_reader.NewFileReader(testFileName, 64)
+	startReader, err := file_reader.OpenFileReader(file_system.OS, testFileName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -403,14 +586,16 @@ func TestByteRecordingToFileBuffered(t *testing.T) {
 	}
 	_ = outFile.Truncate(0)
 
-	bytes := make(chan byte, 1)
+	pool := newBlockPool(24)
+	blocks := make(chan *[]byte, pipelineDepth)
 	errCh := make(chan error, 1)
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go ByteRecordingToFileBuffered(outFile, bytes, 32, errCh, wg)
+	go func() {
+		errCh <- BlockRecordingToFile(context.Background(), logging.Discard, outFile, nil, blocks, pool, 32)
+	}()
 
 	for !startReader.EOF() {
-		n, batch, err := startReader.ReadBytes()
+		block := pool.Get()
+		n, err := startReader.Read(*block)
 		if errors.Is(err, io.EOF) {
 			if n == 0 {
 				break
@@ -419,26 +604,20 @@ func TestByteRecordingToFileBuffered(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if n < len(batch) {
-			batch = batch[:n]
-		}
-
 		select {
 		case err = <-errCh:
 			t.Fatal(err)
 		default:
 		}
 
-		for i, c := range batch {
-			_ = i
-			bytes <- c
-		}
+		*block = (*block)[:n]
+		blocks <- block
 	}
 
-	close(bytes)
-	wg.Wait()
+	close(blocks)
+	assert.NoError(t, <-errCh)
 
-	outReader, err := file_reader.NewFileReader(outFileName, 64)
+	outReader, err := file_reader.OpenFileReader(file_system.OS, outFileName)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -449,20 +628,23 @@ func TestByteRecordingToFileBuffered(t *testing.T) {
 		fmt.Println("Конечный файл:", outReader.Size())
 	}
 
-	startReader.SetOffset(0)
+	if _, err = startReader.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
 
+	sourceBuf, destBuf := make([]byte, 64), make([]byte, 64)
 	allEOF := false
 	for !allEOF {
 		allEOF = false
 
-		n, sourceText, err := startReader.ReadBytes()
+		n, err := startReader.Read(sourceBuf)
 		if errors.Is(err, io.EOF) {
 			allEOF = true
 		} else if err != nil {
 			t.Fatal(err)
 		}
 
-		m, destText, err := outReader.ReadBytes()
+		m, err := outReader.Read(destBuf)
 		if errors.Is(err, io.EOF) {
 			allEOF = allEOF == true
 		} else if err != nil {
@@ -473,7 +655,7 @@ func TestByteRecordingToFileBuffered(t *testing.T) {
 			t.Error("n != m:", n, "!=", m)
 		}
 
-		assert.Equal(t, sourceText, destText)
+		assert.Equal(t, sourceBuf[:n], destBuf[:m])
 	}
 
 	fmt.Println("End of test")
@@ -501,7 +683,7 @@ func TestSwapTwoFiles(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = SwapTwoFiles("", firstFileName, secondFileName, 64, 32)
+	err = SwapTwoFiles(context.Background(), file_system.OS, logging.Discard, "", firstFileName, secondFileName, 64, 32)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -532,8 +714,2287 @@ func BenchmarkSwapTwoFiles(b *testing.B) {
 	readBlockSize := 4 * 1024
 	writeBlockSize := 4 * 1024
 
-	err := SwapTwoFiles(TestFolderPath, "202209161152.log", "202209152012010000002.log", readBlockSize, writeBlockSize)
+	err := SwapTwoFiles(context.Background(), file_system.OS, logging.Discard, TestFolderPath, "202209161152.log", "202209152012010000002.log", readBlockSize, writeBlockSize)
 	if err != nil {
 		b.Fatal("error:", err)
 	}
 }
+
+// BenchmarkSwapTwoFilesBlockSizes compares the throughput of the swap for different -rbs and -wbs.
+func BenchmarkSwapTwoFilesBlockSizes(b *testing.B) {
+	firstFileName := "BenchmarkSwapTwoFilesBlockSizes1.log"
+	secondFileName := "BenchmarkSwapTwoFilesBlockSizes2.log"
+
+	if err := os.WriteFile(TestFolderPath+firstFileName, generateNewLogData(1024*1024), 0600); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(TestFolderPath + firstFileName)
+
+	if err := os.WriteFile(TestFolderPath+secondFileName, generateNewLogData2(1024*1024+512*1024), 0600); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(TestFolderPath + secondFileName)
+
+	blockSizes := []struct {
+		readBlockSize, writeBlockSize int
+	}{
+		{64, 64},
+		{4 * 1024, 4 * 1024},
+		{4 * 1024, 64 * 1024},
+		{64 * 1024, 4 * 1024},
+		{64 * 1024, 64 * 1024},
+		{1024 * 1024, 1024 * 1024},
+	}
+
+	for _, bs := range blockSizes {
+		b.Run(fmt.Sprintf("rbs=%d/wbs=%d", bs.readBlockSize, bs.writeBlockSize), func(b *testing.B) {
+			b.SetBytes(1024*1024 + 1024*1024 + 512*1024)
+			for i := 0; i < b.N; i++ {
+				if err := SwapTwoFiles(context.Background(), file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName, bs.readBlockSize, bs.writeBlockSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSwapTwoFilesJournaled(t *testing.T) {
+	firstFileName := TestFolderPath + "TestSwapTwoFilesJournaled1.log"
+	secondFileName := TestFolderPath + "TestSwapTwoFilesJournaled2.log"
+
+	firstFileData := generateNewLogData(32*1024 + 77)
+	if err := os.WriteFile(firstFileName, firstFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(firstFileName)
+
+	secondFileData := generateNewLogData2(36*1024 + 77)
+	if err := os.WriteFile(secondFileName, secondFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secondFileName)
+
+	if err := SwapTwoFilesJournaled(context.Background(), file_system.OS, logging.Discard, "", firstFileName, secondFileName, 64, 32); err != nil {
+		t.Fatal(err)
+	}
+
+	firstOutData, _ := os.ReadFile(firstFileName)
+	secondOutData, _ := os.ReadFile(secondFileName)
+	assert.Equal(t, secondFileData, firstOutData)
+	assert.Equal(t, firstFileData, secondOutData)
+
+	// The journal and the backups are removed after the swap
+	leftovers, _ := filepath.Glob(TestFolderPath + journalFileName + "*")
+	assert.Empty(t, leftovers)
+}
+
+func TestRecoverSwap(t *testing.T) {
+	firstFileName := TestFolderPath + "TestRecoverSwap1.log"
+	secondFileName := TestFolderPath + "TestRecoverSwap2.log"
+
+	firstFileData := generateNewLogData(32*1024 + 77)
+	secondFileData := generateNewLogData2(36*1024 + 77)
+
+	prepare := func(t *testing.T) *swapJournal {
+		if err := os.WriteFile(firstFileName, firstFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(secondFileName, secondFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		j, err := beginJournal(context.Background(), file_system.OS, filepath.Dir(firstFileName), []string{firstFileName, secondFileName}, []int{1, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+	defer os.Remove(firstFileName)
+	defer os.Remove(secondFileName)
+
+	t.Run("Crash while writing: roll forward", func(t *testing.T) {
+		prepare(t)
+
+		// The first file is half-swapped, the second one is not touched yet
+		halfSwapped := append(append([]byte{}, secondFileData[:1000]...), firstFileData[1000:]...)
+		if err := os.WriteFile(firstFileName, halfSwapped, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		recovered, err := RecoverSwap(context.Background(), file_system.OS, logging.Discard, TestFolderPath)
+		assert.NoError(t, err)
+		assert.True(t, recovered)
+
+		firstOutData, _ := os.ReadFile(firstFileName)
+		secondOutData, _ := os.ReadFile(secondFileName)
+		assert.Equal(t, secondFileData, firstOutData)
+		assert.Equal(t, firstFileData, secondOutData)
+	})
+
+	t.Run("Crash while making backups: roll back", func(t *testing.T) {
+		j := prepare(t)
+		j.State = journalStatePrepare
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		recovered, err := RecoverSwap(context.Background(), file_system.OS, logging.Discard, TestFolderPath)
+		assert.NoError(t, err)
+		assert.True(t, recovered)
+
+		firstOutData, _ := os.ReadFile(firstFileName)
+		secondOutData, _ := os.ReadFile(secondFileName)
+		assert.Equal(t, firstFileData, firstOutData)
+		assert.Equal(t, secondFileData, secondOutData)
+	})
+
+	t.Run("Crash while rolling back: finish the rollback", func(t *testing.T) {
+		j := prepare(t)
+		j.State = journalStateRollback
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first file is half-restored, the second one is still swapped
+		halfRestored := append(append([]byte{}, firstFileData[:1000]...), secondFileData[1000:]...)
+		if err := os.WriteFile(firstFileName, halfRestored, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(secondFileName, firstFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		recovered, err := RecoverSwap(context.Background(), file_system.OS, logging.Discard, TestFolderPath)
+		assert.NoError(t, err)
+		assert.True(t, recovered)
+
+		firstOutData, _ := os.ReadFile(firstFileName)
+		secondOutData, _ := os.ReadFile(secondFileName)
+		assert.Equal(t, firstFileData, firstOutData)
+		assert.Equal(t, secondFileData, secondOutData)
+	})
+
+	t.Run("Failed rollback: finished by the recovery", func(t *testing.T) {
+		mem := file_system.NewMemFS()
+		if err := mem.MkdirAll(TestFolderPath, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := file_system.WriteFile(mem, firstFileName, firstFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := file_system.WriteFile(mem, secondFileName, secondFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// The writes of the first file fail during the swap and the rollback
+		fsys := file_system.NewFaultFS(mem, &file_system.Fault{Op: file_system.OpWrite, Name: filepath.Base(firstFileName), Offset: 1000, Repeat: true})
+		err := SwapTwoFilesJournaled(context.Background(), fsys, logging.Discard, TestFolderPath,
+			filepath.Base(firstFileName), filepath.Base(secondFileName), 512, 512)
+		if assert.ErrorIs(t, err, syscall.EIO) {
+			assert.Contains(t, err.Error(), "rollback failed")
+		}
+
+		j, err := loadJournal(mem, filepath.Clean(TestFolderPath))
+		if assert.NoError(t, err) && assert.NotNil(t, j) {
+			assert.Equal(t, journalStateRollback, j.State)
+		}
+
+		// The failed swap is not rolled forward
+		recovered, err := RecoverSwap(context.Background(), mem, logging.Discard, filepath.Clean(TestFolderPath))
+		assert.NoError(t, err)
+		assert.True(t, recovered)
+
+		firstOutData, _ := file_system.ReadFile(mem, firstFileName)
+		secondOutData, _ := file_system.ReadFile(mem, secondFileName)
+		assert.Equal(t, firstFileData, firstOutData)
+		assert.Equal(t, secondFileData, secondOutData)
+	})
+
+	t.Run("Corrupted backup: checksum mismatch", func(t *testing.T) {
+		j := prepare(t)
+		if err := os.WriteFile(TestFolderPath+j.Entries[1].Backup, generateNewLogData(len(secondFileData)), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := RecoverSwap(context.Background(), file_system.OS, logging.Discard, TestFolderPath)
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+		assert.NoError(t, j.discard())
+	})
+
+	t.Run("No journal", func(t *testing.T) {
+		recovered, err := RecoverSwap(context.Background(), file_system.OS, logging.Discard, TestFolderPath)
+		assert.NoError(t, err)
+		assert.False(t, recovered)
+	})
+
+	leftovers, _ := filepath.Glob(TestFolderPath + journalFileName + "*")
+	assert.Empty(t, leftovers)
+}
+
+func TestSwapStrategies(t *testing.T) {
+	firstFileName := "TestSwapStrategies1.log"
+	secondFileName := "TestSwapStrategies2.log"
+
+	firstFileData := generateNewLogData(32*1024 + 77)
+	secondFileData := generateNewLogData2(36*1024 + 77)
+
+	for _, name := range []string{StrategyAuto, StrategyExchange, StrategyRename, StrategyStream, StrategyZeroCopy} {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(TestFolderPath+firstFileName, firstFileData, 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(TestFolderPath + firstFileName)
+
+			if err := os.WriteFile(TestFolderPath+secondFileName, secondFileData, 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(TestFolderPath + secondFileName)
+
+			strategy, err := NewSwapStrategy(name, 64, 32, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = strategy.Swap(context.Background(), file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName)
+			if errors.Is(err, ErrExchangeNotSupported) {
+				t.Skip(err)
+			}
+			assert.NoError(t, err)
+
+			firstOutData, _ := os.ReadFile(TestFolderPath + firstFileName)
+			secondOutData, _ := os.ReadFile(TestFolderPath + secondFileName)
+			assert.Equal(t, secondFileData, firstOutData)
+			assert.Equal(t, firstFileData, secondOutData)
+
+			leftovers, _ := filepath.Glob(TestFolderPath + journalFileName + "*")
+			assert.Empty(t, leftovers)
+		})
+	}
+
+	_, err := NewSwapStrategy("copy", 64, 32, false)
+	assert.ErrorIs(t, err, ErrUnknownStrategy)
+}
+
+func TestRecoverRenameSwap(t *testing.T) {
+	firstFileName := TestFolderPath + "TestRecoverRenameSwap1.log"
+	secondFileName := TestFolderPath + "TestRecoverRenameSwap2.log"
+
+	firstFileData := generateNewLogData(1024)
+	secondFileData := generateNewLogData2(2048)
+
+	// The process stops after each of the three renames
+	for step := 1; step <= 3; step++ {
+		t.Run(fmt.Sprint("Step ", step), func(t *testing.T) {
+			if err := os.WriteFile(firstFileName, firstFileData, 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(firstFileName)
+
+			if err := os.WriteFile(secondFileName, secondFileData, 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(secondFileName)
+
+			j, err := beginRenameJournal(file_system.OS, filepath.Dir(firstFileName), firstFileName, secondFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tempName := j.path(j.Entries[0].Backup)
+			renames := [][2]string{{firstFileName, tempName}, {secondFileName, firstFileName}, {tempName, secondFileName}}
+			for i, r := range renames[:step] {
+				if i == 2 {
+					// The last rename is made after the first entry is saved as done
+					j.Entries[0].Done = true
+					if err = j.save(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err = os.Rename(r[0], r[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recovered, err := RecoverSwap(context.Background(), file_system.OS, logging.Discard, TestFolderPath)
+			assert.NoError(t, err)
+			assert.True(t, recovered)
+
+			firstOutData, _ := os.ReadFile(firstFileName)
+			secondOutData, _ := os.ReadFile(secondFileName)
+			assert.Equal(t, secondFileData, firstOutData)
+			assert.Equal(t, firstFileData, secondOutData)
+		})
+	}
+}
+
+func TestBlockRecordingToFileRollback(t *testing.T) {
+	outFileName := TestFolderPath + "outCaseBRTFBR.log"
+
+	originalData := generateNewLogData(100*1024 + 7)
+	newData := generateNewLogData2(150*1024 + 13)
+
+	if err := os.WriteFile(outFileName, originalData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outFileName)
+
+	outFile, err := file_reader.OpenFileReader(file_system.OS, outFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outFile.Close()
+
+	snapshot, err := newFileSnapshot(file_system.OS, outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+
+	pool := newBlockPool(1000)
+	blocks := make(chan *[]byte)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- BlockRecordingToFile(context.Background(), logging.Discard, outFile, snapshot, blocks, pool, 32)
+	}()
+
+	// The swap fails after the file was overwritten beyond its original size
+	for data := newData[:120*1024]; len(data) > 0; {
+		block := pool.Get()
+		n := copy(*block, data)
+		data = data[n:]
+		*block = (*block)[:n]
+		blocks <- block
+	}
+	close(blocks)
+	assert.NoError(t, <-errCh)
+	assert.NoError(t, snapshot.Restore())
+
+	outData, err := os.ReadFile(outFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, originalData, outData)
+}
+
+func TestRotateFiles(t *testing.T) {
+	testFolder := TestFolderPath + "TestRotateFiles/"
+	if err := os.MkdirAll(testFolder, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testFolder)
+
+	names := []string{"-20.log", "-3.log", "7.log", "10.log"}
+	data := [][]byte{
+		generateNewLogData(1024),
+		generateNewLogData2(3*1024 + 5),
+		generateNewLogData(77),
+		generateNewLogData2(2 * 1024),
+	}
+
+	// Written in a different order to check the sorting
+	for _, i := range []int{2, 0, 3, 1} {
+		if err := os.WriteFile(testFolder+names[i], data[i], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sortedNames, err := GetSortedFileNames(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{AllowNegativeNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, names, sortedNames)
+
+	if err = RotateFiles(context.Background(), file_system.OS, testFolder, sortedNames); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range names {
+		outData, err := os.ReadFile(testFolder + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, data[(i+1)%len(data)], outData, name)
+	}
+
+	leftovers, _ := filepath.Glob(testFolder + journalFileName + "*")
+	assert.Empty(t, leftovers)
+
+	_, err = GetSortedFileNames(context.Background(), file_system.OS, logging.Discard, TestFolderPath+NamesTestFolderPath+"TC1_1Positive", SelectOptions{AllowNegativeNames: true})
+	assert.ErrorIs(t, err, ErrNotEnoughFiles)
+}
+
+func TestGetFileNamesRecursive(t *testing.T) {
+	testFolder := TestFolderPath + NamesTestFolderPath
+
+	t.Run("Global", func(t *testing.T) {
+		min, max, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{AllowNegativeNames: true, Recursive: true})
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join("TC_LongNames", "-12345678901011121314151617181920.log"), min)
+		assert.Equal(t, filepath.Join("TC_LongNames", "12345678901011121314151617181920.log"), max)
+	})
+
+	t.Run("Global with exclude", func(t *testing.T) {
+		opts := SelectOptions{AllowNegativeNames: true, Recursive: true, Exclude: []string{"TC_LongNames"}}
+		min, max, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join("TC2_1Positive1Negative", "-6000.log"), min)
+		assert.Equal(t, filepath.Join("TC1_1Positive", "9000.log"), max)
+	})
+
+	t.Run("Per directory with include", func(t *testing.T) {
+		opts := SelectOptions{AllowNegativeNames: true, Recursive: true, Include: []string{"TC2_*/*", "TC1_*/*"}}
+		groups, err := GetFileNamesPerDirectory(context.Background(), file_system.OS, logging.Discard, testFolder, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]string{
+			{filepath.Join("TC2_1Positive1Negative", "-6000.log"), filepath.Join("TC2_1Positive1Negative", "5999.log")},
+			{filepath.Join("TC2_2Negative", "-6000.log"), filepath.Join("TC2_2Negative", "-5999.log")},
+			{filepath.Join("TC2_2Positive", "5999.log"), filepath.Join("TC2_2Positive", "6000.log")},
+		}, groups)
+	})
+
+	t.Run("Not recursive", func(t *testing.T) {
+		_, _, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{AllowNegativeNames: true})
+		assert.ErrorIs(t, err, ErrNoFiles)
+	})
+
+	t.Run("Invalid glob", func(t *testing.T) {
+		_, _, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{Recursive: true, Include: []string{"["}})
+		assert.ErrorIs(t, err, ErrInvalidPattern)
+	})
+}
+
+func TestGetFileNamesRecursiveSymlinks(t *testing.T) {
+	testFolder := TestFolderPath + "TestRecursiveSymlinks/"
+	targetFolder := TestFolderPath + "TestRecursiveSymlinksTarget/"
+	defer os.RemoveAll(testFolder)
+	defer os.RemoveAll(targetFolder)
+
+	for _, name := range []string{testFolder + "a/1.log", testFolder + "a/2.log", targetFolder + "3.log", targetFolder + "4.log"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	absTarget, _ := filepath.Abs(targetFolder)
+	if err := os.Symlink(absTarget, testFolder+"b"); err != nil {
+		t.Skip(err)
+	}
+	// Symlink loop
+	if err := os.Symlink("..", testFolder+"a/loop"); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := GetFileNamesPerDirectory(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{Recursive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{filepath.Join("a", "1.log"), filepath.Join("a", "2.log")}}, groups)
+
+	groups, err = GetFileNamesPerDirectory(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{Recursive: true, FollowSymlinks: true})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{filepath.Join("a", "1.log"), filepath.Join("a", "2.log")},
+		{filepath.Join("b", "3.log"), filepath.Join("b", "4.log")},
+	}, groups)
+}
+
+func TestSwapSymlinks(t *testing.T) {
+	testFolder := TestFolderPath + "TestSwapSymlinks/"
+	targetFolder := TestFolderPath + "TestSwapSymlinksTarget/"
+	defer os.RemoveAll(testFolder)
+	defer os.RemoveAll(targetFolder)
+
+	for _, dir := range []string{testFolder, targetFolder} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	firstFileData := generateNewLogData(1000)
+	secondFileData := generateNewLogData2(3000)
+	writeTargets := func() {
+		if err := os.WriteFile(targetFolder+"first.data", firstFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(targetFolder+"second.data", secondFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTargets()
+
+	absTarget, _ := filepath.Abs(targetFolder)
+	if err := os.Symlink(filepath.Join(absTarget, "first.data"), testFolder+"1.log"); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(filepath.Join(absTarget, "second.data"), testFolder+"2.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Symlinks to files are selected without following the symlinks, like in the non-recursive mode before it
+	for _, opts := range []SelectOptions{{}, {FollowSymlinks: true}, {Recursive: true}} {
+		min, max, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1.log", "2.log"}, []string{min, max})
+	}
+	names, err := GetSortedFileNames(context.Background(), file_system.OS, logging.Discard, testFolder, SelectOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.log", "2.log"}, names)
+
+	assertLinks := func() {
+		for name, target := range map[string]string{"1.log": "first.data", "2.log": "second.data"} {
+			link, err := os.Readlink(testFolder + name)
+			assert.NoError(t, err)
+			assert.Equal(t, target, filepath.Base(link))
+		}
+	}
+
+	// The strategies that swap directory entries don't swap the symlinks
+	for _, name := range []string{StrategyExchange, StrategyRename} {
+		strategy, _ := NewSwapStrategy(name, 64, 64, false)
+		err = strategy.Swap(context.Background(), file_system.OS, logging.Discard, testFolder, "1.log", "2.log")
+		assert.ErrorIs(t, err, ErrSymlinkNotSupported, name)
+		assertLinks()
+		firstOutData, _ := os.ReadFile(targetFolder + "first.data")
+		assert.Equal(t, firstFileData, firstOutData, name)
+
+		plan, err := PlanSwap(file_system.OS, strategy, testFolder, "1.log", "2.log")
+		if assert.NoError(t, err) {
+			assert.Contains(t, strings.Join(plan.Warnings, "\n"), "symlinks", name)
+		}
+	}
+
+	// The other strategies swap the contents of the targets
+	for _, name := range []string{StrategyAuto, StrategyStream, StrategyZeroCopy} {
+		writeTargets()
+		strategy, _ := NewSwapStrategy(name, 64, 64, false)
+		assert.NoError(t, strategy.Swap(context.Background(), file_system.OS, logging.Discard, testFolder, "1.log", "2.log"), name)
+		assertLinks()
+		firstOutData, _ := os.ReadFile(targetFolder + "first.data")
+		assert.Equal(t, secondFileData, firstOutData, name)
+		secondOutData, _ := os.ReadFile(targetFolder + "second.data")
+		assert.Equal(t, firstFileData, secondOutData, name)
+	}
+}
+
+func TestSwapRecursiveGlobal(t *testing.T) {
+	testFolder := TestFolderPath + "TestSwapRecursiveGlobal/"
+	defer os.RemoveAll(testFolder)
+
+	firstFileData := generateNewLogData(1024)
+	secondFileData := generateNewLogData2(2048)
+
+	for name, data := range map[string][]byte{testFolder + "a/1.log": firstFileData, testFolder + "b/c/2.log": secondFileData} {
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := SelectOptions{Recursive: true}
+	for _, name := range []string{StrategyRename, StrategyStream} {
+		t.Run(name, func(t *testing.T) {
+			min, max, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			strategy, err := NewSwapStrategy(name, 64, 32, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, strategy.Swap(context.Background(), file_system.OS, logging.Discard, testFolder, min, max))
+
+			firstOutData, _ := os.ReadFile(testFolder + min)
+			secondOutData, _ := os.ReadFile(testFolder + max)
+			assert.Equal(t, secondFileData, firstOutData)
+			assert.Equal(t, firstFileData, secondOutData)
+
+			// Swap back for the next strategy
+			assert.NoError(t, strategy.Swap(context.Background(), file_system.OS, logging.Discard, testFolder, min, max))
+
+			recovered, err := RecoverSwaps(context.Background(), file_system.OS, logging.Discard, testFolder, opts)
+			assert.NoError(t, err)
+			assert.Zero(t, recovered)
+		})
+	}
+}
+
+func TestGetFileNamesWithMinMaxNameNumBatches(t *testing.T) {
+	testFolder := TestFolderPath + "TestMinMaxBatches/"
+	if err := os.MkdirAll(testFolder, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testFolder)
+
+	// More files than in one batch
+	const filesCount = readDirBatchSize*2 + 17
+	for i := 0; i < filesCount; i++ {
+		if err := os.WriteFile(fmt.Sprintf("%s%d.log", testFolder, i*7-100), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var progress []int
+	opts := SelectOptions{
+		AllowNegativeNames: true,
+		Progress: func(scanned int) {
+			progress = append(progress, scanned)
+		},
+	}
+
+	min, max, err := GetFileNamesWithMinMaxNameNum(context.Background(), file_system.OS, logging.Discard, testFolder, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "-100.log", min)
+	assert.Equal(t, fmt.Sprintf("%d.log", (filesCount-1)*7-100), max)
+	assert.Equal(t, []int{readDirBatchSize, readDirBatchSize * 2, filesCount}, progress)
+}
+
+func TestPlanSwap(t *testing.T) {
+	firstFileName := "TestPlanSwap1.log"
+	secondFileName := "TestPlanSwap2.log"
+	linkName := "TestPlanSwap3.log"
+
+	firstFileData := generateNewLogData(1000)
+	secondFileData := generateNewLogData2(3000)
+
+	if err := os.WriteFile(TestFolderPath+firstFileName, firstFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(TestFolderPath + firstFileName)
+
+	if err := os.WriteFile(TestFolderPath+secondFileName, secondFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(TestFolderPath + secondFileName)
+
+	strategy, err := NewSwapStrategy(StrategyStream, 64, 32, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanSwap(file_system.OS, strategy, TestFolderPath, firstFileName, secondFileName)
+	assert.NoError(t, err)
+	assert.Equal(t, []PlannedFile{{Name: firstFileName, Size: 1000}, {Name: secondFileName, Size: 3000}}, plan.Files)
+	assert.Equal(t, StrategyStream, plan.Strategy)
+	assert.Equal(t, int64(4000), plan.BytesRead)
+	assert.Equal(t, int64(4000), plan.BytesWritten)
+	assert.Equal(t, int64(2000), plan.ExtraSpace)
+	assert.Equal(t, int64(2000), plan.TempSpace)
+	assert.Empty(t, plan.Warnings)
+
+	journalStrategy, err := NewSwapStrategy(StrategyStream, 64, 32, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err = PlanSwap(file_system.OS, journalStrategy, TestFolderPath, firstFileName, secondFileName)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8000), plan.BytesRead)
+	assert.Equal(t, int64(6000), plan.ExtraSpace)
+	assert.Zero(t, plan.TempSpace)
+
+	plan, err = PlanRotation(file_system.OS, TestFolderPath, []string{firstFileName, secondFileName})
+	assert.NoError(t, err)
+	assert.Equal(t, "rotation", plan.Strategy)
+	assert.Equal(t, int64(8000), plan.BytesWritten)
+
+	// Hard links to the same file
+	if err = os.Link(TestFolderPath+firstFileName, TestFolderPath+linkName); err != nil {
+		t.Skip(err)
+	}
+	defer os.Remove(TestFolderPath + linkName)
+
+	plan, err = PlanSwap(file_system.OS, strategy, TestFolderPath, firstFileName, linkName)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Warnings, 1)
+
+	_, err = PlanSwap(file_system.OS, strategy, TestFolderPath, firstFileName, "TestPlanSwapMissing.log")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// The files are not modified
+	firstOutData, _ := os.ReadFile(TestFolderPath + firstFileName)
+	secondOutData, _ := os.ReadFile(TestFolderPath + secondFileName)
+	assert.Equal(t, firstFileData, firstOutData)
+	assert.Equal(t, secondFileData, secondOutData)
+}
+
+func TestFindInterruptedSwaps(t *testing.T) {
+	dir := TestFolderPath + "TestFindInterruptedSwaps"
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(filepath.Join(dir, "sub", journalFileName), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The journals left by the recursive runs are found by any run
+	for _, opts := range []SelectOptions{{}, {Recursive: true}, {Recursive: true, Exclude: []string{"sub"}}} {
+		dirs, err := FindInterruptedSwaps(context.Background(), file_system.OS, logging.Discard, dir, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "sub")}, dirs)
+	}
+
+	// The journal is not touched
+	_, err := os.Stat(filepath.Join(dir, "sub", journalFileName))
+	assert.NoError(t, err)
+
+	// A swap interrupted in a subdirectory is recovered by a non-recursive run
+	subdir := filepath.Join(dir, "sub")
+	firstFileData := generateNewLogData(1000)
+	secondFileData := generateNewLogData2(3000)
+	if err = os.Remove(filepath.Join(subdir, journalFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(subdir, "1.log"), firstFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(subdir, "2.log"), secondFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = beginJournal(context.Background(), file_system.OS, subdir, []string{filepath.Join(subdir, "1.log"), filepath.Join(subdir, "2.log")}, []int{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := RecoverSwaps(context.Background(), file_system.OS, logging.Discard, dir, SelectOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, recovered)
+	firstOutData, _ := os.ReadFile(filepath.Join(subdir, "1.log"))
+	assert.Equal(t, secondFileData, firstOutData)
+}
+
+func TestFindSwapStages(t *testing.T) {
+	dir := TestFolderPath + "TestFindSwapStages/"
+	configPath := TestFolderPath + "TestFindSwapStages.yml"
+	if err := os.MkdirAll(dir+"sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configPath)
+
+	for name, data := range map[string][]byte{"1.log": generateNewLogData(1000), "2.log": generateNewLogData2(3000), "sub/.swap-stage-123": []byte("stage")} {
+		if err := os.WriteFile(dir+name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stage := filepath.Join(dir, "sub", ".swap-stage-123")
+
+	// The stage files left in the subdirectories are found by any run
+	for _, opts := range []SelectOptions{{}, {Recursive: true}} {
+		stages, err := FindSwapStages(context.Background(), file_system.OS, logging.Discard, dir, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{stage}, stages)
+	}
+
+	// The runs report the stage file and keep it
+	opts := runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputJSON,
+		readBlockSize:  64,
+		writeBlockSize: 64,
+	}
+	for _, dryRun := range []bool{true, false} {
+		opts.dryRun = dryRun
+		var out bytes.Buffer
+		result := run(context.Background(), file_system.OS, logging.Discard, opts, &out)
+		assert.Nil(t, result.Error)
+		if assert.Len(t, result.Warnings, 1) {
+			assert.True(t, strings.HasPrefix(result.Warnings[0], stage+" is left by an interrupted zerocopy swap"))
+		}
+		assert.Contains(t, out.String(), "Warning: "+stage)
+	}
+
+	data, err := os.ReadFile(stage)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("stage"), data)
+}
+
+func TestRunOutputJSON(t *testing.T) {
+	dir := TestFolderPath + "TestRunOutputJSON/"
+	configPath := TestFolderPath + "TestRunOutputJSON.yml"
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configPath)
+
+	opts := runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputJSON,
+		readBlockSize:  64,
+		writeBlockSize: 64,
+	}
+
+	// There are no files
+	result := run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	assert.Equal(t, &ResultError{Code: ErrorCodeNoFiles, ExitCode: ExitNoFiles, Message: "GetFileNamesWithMinMaxNameNum: " + ErrNoFiles.Error() + " ([0-9]*.log)"}, result.Error)
+
+	firstFileData := generateNewLogData(1000)
+	if err := os.WriteFile(dir+"1.log", firstFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeNotEnoughFiles, result.Error.Code)
+		assert.Equal(t, ExitNotEnoughFiles, result.Error.ExitCode)
+	}
+
+	secondFileData := generateNewLogData2(3000)
+	if err := os.WriteFile(dir+"2.log", secondFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	assert.Equal(t, OperationSwap, result.Operation)
+	assert.Equal(t, StrategyStream, result.Strategy)
+	assert.Equal(t, int64(4000), result.Bytes)
+	assert.Equal(t, int64(4000), result.BytesRead)
+	assert.Equal(t, int64(4000), result.BytesWritten)
+	if assert.Len(t, result.Groups, 1) {
+		firstChecksum, _ := fileChecksum(file_system.OS, dir+"1.log")
+		secondChecksum, _ := fileChecksum(file_system.OS, dir+"2.log")
+		assert.Equal(t, []ResultFile{
+			{Name: "1.log", Size: 1000, SHA256: firstChecksum},
+			{Name: "2.log", Size: 3000, SHA256: secondChecksum},
+		}, result.Groups[0].Files)
+	}
+
+	firstOutData, _ := os.ReadFile(dir + "1.log")
+	assert.Equal(t, secondFileData, firstOutData)
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeRunResult(&buf, result))
+	var decoded RunResult
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, *result, decoded)
+
+	// The journaled swap also writes the backups of both files
+	opts.journal = true
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	assert.Equal(t, int64(8000), result.BytesRead)
+	assert.Equal(t, int64(8000), result.BytesWritten)
+	opts.journal = false
+
+	// Config errors
+	opts.strategyName = "copy"
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeConfig, result.Error.Code)
+		assert.Equal(t, ExitConfig, result.Error.ExitCode)
+	}
+
+	opts.strategyName = StrategyStream
+	opts.configPath = TestFolderPath + "TestRunOutputJSONMissing.yml"
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ExitConfig, result.Error.ExitCode)
+	}
+
+	// Cancellation by a signal
+	opts.configPath = configPath
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = run(canceled, file_system.OS, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeCanceled, result.Error.Code)
+		assert.Equal(t, ExitCanceled, result.Error.ExitCode)
+	}
+
+	// I/O errors
+	assert.Equal(t, ErrorCodeIO, errorCode(&os.PathError{Op: "open", Path: dir, Err: os.ErrPermission}))
+}
+
+func TestFileReaderChecksum(t *testing.T) {
+	testFileName := TestFolderPath + "TestFileReaderChecksum.log"
+	testFileData := generateNewLogData(10*1024 + 7)
+
+	if err := os.WriteFile(testFileName, testFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testFileName)
+
+	reader, err := file_reader.OpenFileReader(file_system.OS, testFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// The bytes appended after the file is opened are not read
+	if err = os.WriteFile(testFileName, append(testFileData, "appended"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := io.Copy(io.Discard, reader)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(testFileData)), read)
+
+	expected := sha256.Sum256(testFileData)
+	assert.Equal(t, expected[:], reader.Checksum())
+
+	// The file was changed after it was read
+	assert.ErrorIs(t, verifyChecksum(file_system.OS, testFileName, reader.Checksum()), ErrChecksumMismatch)
+	appended := sha256.Sum256(append(testFileData, "appended"...))
+	assert.NoError(t, verifyChecksum(file_system.OS, testFileName, appended[:]))
+}
+
+func TestFileReaderIO(t *testing.T) {
+	testFileName := TestFolderPath + "TestFileReaderIO.log"
+	testFileData := generateNewLogData(4*1024 + 3)
+
+	if err := os.WriteFile(testFileName, testFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testFileName)
+
+	reader, err := file_reader.OpenFileReader(file_system.OS, testFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var _ io.ReadSeeker = reader
+	var _ io.ReaderAt = reader
+	var _ io.WriterAt = reader
+
+	// Composes with bufio
+	line, err := bufio.NewReader(reader).ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, testFileData[:len(line)], line)
+
+	offset, err := reader.Seek(-3, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(testFileData)-3), offset)
+
+	tail, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, testFileData[len(testFileData)-3:], tail)
+	assert.True(t, reader.EOF())
+
+	_, err = reader.Seek(-1, io.SeekStart)
+	assert.ErrorIs(t, err, file_reader.ErrNegativeOffset)
+
+	// WriteAt and ReadAt don't change the position and the size
+	_, err = reader.WriteAt([]byte("xyz"), int64(len(testFileData)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(testFileData)), reader.Size())
+
+	buf := make([]byte, 3)
+	_, err = reader.ReadAt(buf, int64(len(testFileData)))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("xyz"), buf)
+
+	n, err := reader.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Reading from the beginning again gives the checksum of the content read by Read
+	_, err = reader.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = io.Copy(io.Discard, reader)
+	assert.NoError(t, err)
+	expected := sha256.Sum256(testFileData)
+	assert.Equal(t, expected[:], reader.Checksum())
+}
+
+func TestFileReaderDeprecated(t *testing.T) {
+	testFileName := TestFolderPath + "TestFileReaderDeprecated.log"
+	testFileData := generateNewLogData(100)
+
+	if err := os.WriteFile(testFileName, testFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testFileName)
+
+	_, err := file_reader.NewFileReader(testFileName, 0)
+	assert.ErrorIs(t, err, file_reader.ErrInvalidBlockSize)
+
+	reader, err := file_reader.NewFileReader(testFileName, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	assert.Equal(t, testFileName, reader.GetFile().Name())
+
+	// The blocks of the block size are read into the internal buffer
+	n, block, err := reader.ReadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, testFileData[:64], block[:n])
+	n, block, err = reader.ReadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, testFileData[64:], block[:n])
+	n, _, err = reader.ReadBytes()
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.True(t, reader.EOF())
+
+	reader.SetOffset(-1)
+	reader.SetOffset(10)
+	n, block, err = reader.ReadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, testFileData[10:74], block[:n])
+
+	// The readers opened without a block size have no buffer
+	opened, err := file_reader.OpenFileReader(file_system.NewMemFS(), "")
+	assert.ErrorIs(t, err, file_reader.ErrInvalidFileName)
+	assert.Nil(t, opened)
+	mem := file_system.NewMemFS()
+	assert.NoError(t, file_system.WriteFile(mem, "1.log", testFileData, 0600))
+	opened, err = file_reader.OpenFileReader(mem, "1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opened.Close()
+	assert.Nil(t, opened.GetFile())
+	_, _, err = opened.ReadBytes()
+	assert.ErrorIs(t, err, file_reader.ErrInvalidBlockSize)
+}
+
+func TestSwapTwoFilesZeroCopy(t *testing.T) {
+	firstFileName := "TestSwapTwoFilesZeroCopy1.log"
+	secondFileName := "TestSwapTwoFilesZeroCopy2.log"
+
+	testCases := []struct {
+		name                      string
+		firstFileSize, secondSize int
+	}{
+		{"First is smaller", 1024, 300*1024 + 5},
+		{"First is bigger", 300*1024 + 5, 1024},
+		{"Empty file", 0, 4096},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			firstFileData := generateNewLogData(tc.firstFileSize)
+			secondFileData := generateNewLogData2(tc.secondSize)
+
+			if err := os.WriteFile(TestFolderPath+firstFileName, firstFileData, 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(TestFolderPath + firstFileName)
+
+			if err := os.WriteFile(TestFolderPath+secondFileName, secondFileData, 0600); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(TestFolderPath + secondFileName)
+
+			_, err := SwapTwoFilesZeroCopy(context.Background(), file_system.OS, TestFolderPath, firstFileName, secondFileName)
+			assert.NoError(t, err)
+
+			firstOutData, _ := os.ReadFile(TestFolderPath + firstFileName)
+			secondOutData, _ := os.ReadFile(TestFolderPath + secondFileName)
+			assert.Equal(t, secondFileData, firstOutData)
+			assert.Equal(t, firstFileData, secondOutData)
+
+			leftovers, _ := filepath.Glob(TestFolderPath + ".swap-stage-*")
+			assert.Empty(t, leftovers)
+		})
+	}
+
+	_, err := SwapTwoFilesZeroCopy(context.Background(), file_system.OS, TestFolderPath, firstFileName, secondFileName)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCopyFileRange(t *testing.T) {
+	srcFileName := TestFolderPath + "TestCopyFileRange1.log"
+	dstFileName := TestFolderPath + "TestCopyFileRange2.log"
+
+	srcData := generateNewLogData(64*1024 + 11)
+	dstData := generateNewLogData2(16 * 1024)
+
+	if err := os.WriteFile(srcFileName, srcData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(srcFileName)
+
+	if err := os.WriteFile(dstFileName, dstData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dstFileName)
+
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstFileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Only the region is copied, the beginning of the destination is kept
+	_, err = copyFileRange(context.Background(), dst, src, 1000, 40*1024)
+	assert.NoError(t, err)
+
+	dstOutData, _ := os.ReadFile(dstFileName)
+	assert.Equal(t, dstData[:1000], dstOutData[:1000])
+	assert.Equal(t, srcData[1000:40*1024], dstOutData[1000:])
+
+	// The source is shorter than the region
+	_, err = copyFileRange(context.Background(), dst, src, 0, int64(len(srcData))+10)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestSwapCanceled(t *testing.T) {
+	firstFileName := "TestSwapCanceled1.log"
+	secondFileName := "TestSwapCanceled2.log"
+
+	firstFileData := generateNewLogData(2*1024*1024 + 77)
+	secondFileData := generateNewLogData2(3*1024*1024 + 5)
+
+	writeFiles := func(t *testing.T) {
+		if err := os.WriteFile(TestFolderPath+firstFileName, firstFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(TestFolderPath+secondFileName, secondFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Remove(TestFolderPath + firstFileName)
+	defer os.Remove(TestFolderPath + secondFileName)
+
+	assertUntouched := func(t *testing.T) {
+		firstOutData, _ := os.ReadFile(TestFolderPath + firstFileName)
+		secondOutData, _ := os.ReadFile(TestFolderPath + secondFileName)
+		assert.Equal(t, firstFileData, firstOutData)
+		assert.Equal(t, secondFileData, secondOutData)
+
+		leftovers, _ := filepath.Glob(TestFolderPath + ".swap*")
+		assert.Empty(t, leftovers)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, name := range []string{StrategyAuto, StrategyExchange, StrategyRename, StrategyStream, StrategyZeroCopy} {
+		t.Run(name, func(t *testing.T) {
+			writeFiles(t)
+
+			strategy, err := NewSwapStrategy(name, 64, 64, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.ErrorIs(t, strategy.Swap(canceled, file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName), context.Canceled)
+			assertUntouched(t)
+		})
+	}
+
+	t.Run("Rotation", func(t *testing.T) {
+		writeFiles(t)
+		assert.ErrorIs(t, RotateFiles(canceled, file_system.OS, TestFolderPath, []string{firstFileName, secondFileName}), context.Canceled)
+		assertUntouched(t)
+	})
+
+	// Small blocks make the swap slow enough to be canceled in the middle
+	t.Run("In progress", func(t *testing.T) {
+		writeFiles(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(20*time.Millisecond, cancel)
+
+		assert.ErrorIs(t, SwapTwoFiles(ctx, file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName, 8, 8), context.Canceled)
+		assertUntouched(t)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		writeFiles(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, SwapTwoFilesJournaled(ctx, file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName, 8, 8), context.DeadlineExceeded)
+		assertUntouched(t)
+		assert.Equal(t, ErrorCodeTimeout, errorCode(ctx.Err()))
+	})
+}
+
+func TestLocking(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("advisory locks are not supported")
+	}
+
+	dir := TestFolderPath + "TestLocking/"
+	configPath := TestFolderPath + "TestLocking.yml"
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configPath)
+
+	firstFileData := generateNewLogData(1000)
+	secondFileData := generateNewLogData2(3000)
+	if err := os.WriteFile(dir+"1.log", firstFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"2.log", secondFileData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputJSON,
+		readBlockSize:  64,
+		writeBlockSize: 64,
+	}
+
+	// The dry run doesn't create the lock file
+	opts.dryRun = true
+	result := run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	assert.Empty(t, result.Warnings)
+	_, err := os.Stat(dir + lockFileName)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	opts.dryRun = false
+
+	// A file opened for a swap can't be opened by another one, the reader package itself doesn't lock the files
+	reader, err := openFileReader(file_system.OS, logging.Discard, dir+"1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openFileReader(file_system.OS, logging.Discard, dir+"1.log")
+	assert.ErrorIs(t, err, file_lock.ErrLocked)
+	unlockedReader, err := file_reader.OpenFileReader(file_system.OS, dir+"1.log")
+	if assert.NoError(t, err) {
+		assert.NoError(t, unlockedReader.Close())
+	}
+	assert.ErrorIs(t, SwapTwoFiles(context.Background(), file_system.OS, logging.Discard, dir, "1.log", "2.log", 64, 64), file_lock.ErrLocked)
+	// Every strategy and the rotation lock the files
+	assert.ErrorIs(t, SwapTwoFilesJournaled(context.Background(), file_system.OS, logging.Discard, dir, "1.log", "2.log", 64, 64), file_lock.ErrLocked)
+	_, err = SwapTwoFilesZeroCopy(context.Background(), file_system.OS, dir, "1.log", "2.log")
+	assert.ErrorIs(t, err, file_lock.ErrLocked)
+	assert.ErrorIs(t, exchangeStrategy{}.Swap(context.Background(), file_system.OS, logging.Discard, dir, "1.log", "2.log"), file_lock.ErrLocked)
+	assert.ErrorIs(t, renameStrategy{}.Swap(context.Background(), file_system.OS, logging.Discard, dir, "1.log", "2.log"), file_lock.ErrLocked)
+	assert.ErrorIs(t, RotateFiles(context.Background(), file_system.OS, dir, []string{"1.log", "2.log"}), file_lock.ErrLocked)
+	leftovers, _ := filepath.Glob(dir + ".swap*")
+	assert.Empty(t, leftovers)
+	// The files of a filesystem wrapping the OS one are locked too
+	faultFS := file_system.NewFaultFS(file_system.OS)
+	_, err = openFileReader(faultFS, logging.Discard, dir+"1.log")
+	assert.ErrorIs(t, err, file_lock.ErrLocked)
+	assert.NoError(t, reader.Close())
+
+	// The directory is locked by another run
+	lock, err := file_lock.LockFile(context.Background(), dir+lockFileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeLocked, result.Error.Code)
+		assert.Equal(t, ExitLocked, result.Error.ExitCode)
+		assert.Contains(t, result.Error.Message, fmt.Sprintf("PID %d", os.Getpid()))
+	}
+	result = run(context.Background(), faultFS, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeLocked, result.Error.Code)
+	}
+
+	// The dry run only warns
+	opts.dryRun = true
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	assert.Len(t, result.Warnings, 1)
+	opts.dryRun = false
+
+	// The run waits until the lock is released
+	opts.lockWait = time.Minute
+	unlocked := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() {
+		_ = lock.Unlock()
+		close(unlocked)
+	})
+	result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	<-unlocked
+
+	firstOutData, _ := os.ReadFile(dir + "1.log")
+	assert.Equal(t, secondFileData, firstOutData)
+	secondOutData, _ := os.ReadFile(dir + "2.log")
+	assert.Equal(t, firstFileData, secondOutData)
+
+	// Hard links to the same file don't lock each other out, they are skipped
+	if err = os.Link(dir+"1.log", dir+"3.log"); err != nil {
+		t.Skip(err)
+	}
+	assert.ErrorIs(t, SwapTwoFiles(context.Background(), file_system.OS, logging.Discard, dir, "1.log", "3.log", 64, 64), ErrSameFile)
+	_, err = SwapTwoFilesZeroCopy(context.Background(), file_system.OS, dir, "1.log", "3.log")
+	assert.ErrorIs(t, err, ErrSameFile)
+	assert.ErrorIs(t, RotateFiles(context.Background(), file_system.OS, dir, []string{"1.log", "2.log", "3.log"}), ErrSameFile)
+
+	for _, rotate := range []bool{false, true} {
+		opts.rotate = rotate
+		result = run(context.Background(), file_system.OS, logging.Discard, opts, io.Discard)
+		assert.Nil(t, result.Error)
+		assert.Empty(t, result.Groups)
+		if assert.Len(t, result.Warnings, 1) {
+			assert.Contains(t, result.Warnings[0], ErrSameFile.Error())
+		}
+	}
+
+	firstOutData, _ = os.ReadFile(dir + "1.log")
+	assert.Equal(t, secondFileData, firstOutData)
+	secondOutData, _ = os.ReadFile(dir + "2.log")
+	assert.Equal(t, firstFileData, secondOutData)
+}
+
+func TestSwapMetadata(t *testing.T) {
+	dir := TestFolderPath + "TestSwapMetadata/"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"1.log", "2.log"}
+	modes := []os.FileMode{0600, 0640}
+	mtimes := []time.Time{time.Unix(1600000000, 100), time.Unix(1700000000, 200)}
+	atimes := []time.Time{time.Unix(1610000000, 300), time.Unix(1710000000, 400)}
+	owners := []int{os.Getuid(), 1234}
+
+	create := func() {
+		for i, name := range names {
+			if err := os.WriteFile(dir+name, generateNewLogData(1000*(i+1)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir+name, modes[i]); err != nil {
+				t.Fatal(err)
+			}
+			if os.Getuid() == 0 {
+				if err := os.Chown(dir+name, owners[i], owners[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Skipped by the check below if the filesystem doesn't support extended attributes
+			_ = setXattrs(dir+name, map[string][]byte{"user.swap_test": []byte(name)})
+			if err := os.Chtimes(dir+name, atimes[i], mtimes[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// check checks that every file has the metadata of the file with the index from expected
+	check := func(expected []int) {
+		for i, name := range names {
+			m, err := readMetadata(dir + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j := expected[i]
+			assert.Equal(t, modes[j], m.mode, name)
+			assert.True(t, mtimes[j].Equal(m.mtime), name)
+			if runtime.GOOS == "linux" {
+				assert.True(t, atimes[j].Equal(m.atime), name)
+				if len(m.xattrs) > 0 {
+					assert.Equal(t, []byte(names[j]), m.xattrs["user.swap_test"], name)
+				}
+			}
+			if os.Getuid() == 0 && m.hasOwner {
+				assert.Equal(t, owners[j], m.uid, name)
+				assert.Equal(t, owners[j], m.gid, name)
+			}
+		}
+	}
+
+	for _, strategyName := range []string{StrategyStream, StrategyRename} {
+		strategy, _ := NewSwapStrategy(strategyName, 64, 64, false)
+
+		for _, mode := range []string{MetadataKeep, MetadataSwap} {
+			create()
+
+			metadata, err := captureMetadata(dir, names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, strategy.Swap(context.Background(), file_system.OS, logging.Discard, dir, names[0], names[1]))
+			assert.NoError(t, restoreMetadata(mode, dir, names, metadata))
+
+			if mode == MetadataKeep {
+				check([]int{0, 1})
+			} else {
+				check([]int{1, 0})
+			}
+
+			firstOutData, _ := os.ReadFile(dir + names[0])
+			assert.Equal(t, generateNewLogData(2000), firstOutData)
+		}
+	}
+
+	// A failure doesn't stop the restoring of the other files
+	create()
+	metadata, err := captureMetadata(dir, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(dir+names[0], 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = restoreMetadata(MetadataKeep, dir, []string{"missing.log", names[0]}, []*fileMetadata{metadata[1], metadata[0]})
+	if assert.ErrorIs(t, err, os.ErrNotExist) {
+		assert.Contains(t, err.Error(), "missing.log")
+	}
+	fileStats, err := os.Stat(dir + names[0])
+	if assert.NoError(t, err) {
+		assert.Equal(t, modes[0], fileStats.Mode().Perm())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("watching a directory is supported on Linux only")
+	}
+
+	dir := TestFolderPath + "TestWatch/"
+	configPath := TestFolderPath + "TestWatch.yml"
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configPath)
+
+	for i := 1; i <= 2; i++ {
+		if err := os.WriteFile(fmt.Sprintf("%s%d.log", dir, i), generateNewLogData(100*i), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputJSON,
+		readBlockSize:  64,
+		writeBlockSize: 64,
+		debounce:       50 * time.Millisecond,
+	}
+
+	// startWatch starts the watch with the policy and returns the channel of the results
+	// and the function that stops the watch and returns its error
+	startWatch := func(policy string) (<-chan *RunResult, func() *ResultError) {
+		opts.watchPolicy = policy
+		ctx, cancel := context.WithCancel(context.Background())
+		results := make(chan *RunResult, 10)
+		watchErr := make(chan *ResultError, 1)
+		go func() {
+			watchErr <- watch(ctx, file_system.OS, logging.Discard, opts, io.Discard, func(result *RunResult) {
+				results <- result
+			})
+		}()
+		// Waiting until the watch is started
+		time.Sleep(50 * time.Millisecond)
+		return results, func() *ResultError {
+			cancel()
+			return <-watchErr
+		}
+	}
+
+	waitResult := func(results <-chan *RunResult) *RunResult {
+		select {
+		case result := <-results:
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatal("no swap")
+			return nil
+		}
+	}
+
+	assertNoResult := func(results <-chan *RunResult) {
+		select {
+		case result := <-results:
+			t.Errorf("unexpected swap: %+v", result)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	appendFile := func(name string) {
+		f, err := os.OpenFile(dir+name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write([]byte("new line\n"))
+		_ = f.Close()
+	}
+
+	// Any change triggers a swap, the changes made by the swap itself don't
+	results, stop := startWatch(WatchPolicyChange)
+
+	if err := os.WriteFile(dir+"3.log", generateNewLogData2(300), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result := waitResult(results)
+	if assert.Nil(t, result.Error) && assert.Len(t, result.Groups, 1) {
+		assert.Equal(t, "1.log", result.Groups[0].Files[0].Name)
+		assert.Equal(t, "3.log", result.Groups[0].Files[1].Name)
+	}
+	firstOutData, _ := os.ReadFile(dir + "1.log")
+	assert.Equal(t, generateNewLogData2(300), firstOutData)
+
+	// A change of a swapped file right after the swap is not taken for an event of the swap
+	appendFile("1.log")
+	result = waitResult(results)
+	assert.Nil(t, result.Error)
+	assertNoResult(results)
+
+	// Files that don't fit the conditions are ignored
+	if err := os.WriteFile(dir+"notes.txt", []byte("notes"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assertNoResult(results)
+
+	appendFile("2.log")
+	result = waitResult(results)
+	assert.Nil(t, result.Error)
+	assert.Nil(t, stop())
+
+	// Only a new min or max file triggers a swap
+	results, stop = startWatch(WatchPolicyPair)
+
+	appendFile("2.log")
+	assertNoResult(results)
+
+	if err := os.WriteFile(dir+"4.log", generateNewLogData2(400), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result = waitResult(results)
+	if assert.Nil(t, result.Error) && assert.Len(t, result.Groups, 1) {
+		assert.Equal(t, "1.log", result.Groups[0].Files[0].Name)
+		assert.Equal(t, "4.log", result.Groups[0].Files[1].Name)
+	}
+
+	appendFile("4.log")
+	assertNoResult(results)
+	assert.Nil(t, stop())
+
+	// Invalid options
+	opts.recursiveMode = RecursiveDir
+	_, stop = startWatch(WatchPolicyChange)
+	if err := stop(); assert.NotNil(t, err) {
+		assert.Equal(t, ErrorCodeConfig, err.Code)
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := TestFolderPath + "TestServe/"
+	configPath := TestFolderPath + "TestServe.yml"
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configPath)
+
+	opts := runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputText,
+		readBlockSize:  64,
+		writeBlockSize: 64,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, resultErr := newServer(ctx, file_system.OS, logging.Discard, opts)
+	if resultErr != nil {
+		t.Fatal(resultErr.Message)
+	}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	request := func(method, path string, v interface{}) int {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	type errorResponse struct {
+		Error ResultError `json:"error"`
+	}
+
+	// There are no files
+	var files FileList
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/files", &files))
+	assert.Empty(t, files.Files)
+
+	var errResp errorResponse
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/pair", &errResp))
+	assert.Equal(t, ErrorCodeNoFiles, errResp.Error.Code)
+
+	errResp = errorResponse{}
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/result", &errResp))
+	assert.Equal(t, ErrorCodeNoResult, errResp.Error.Code)
+	assert.Zero(t, errResp.Error.ExitCode)
+
+	var status SwapStatus
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/swap", &status))
+	assert.Equal(t, SwapStateIdle, status.State)
+
+	// The files are listed in the numeric order
+	filesData := map[string][]byte{
+		"10.log":  generateNewLogData(1000),
+		"9.log":   generateNewLogData2(900),
+		"100.log": generateNewLogData(100),
+	}
+	for name, data := range filesData {
+		if err := os.WriteFile(dir+name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/files", &files))
+	assert.Equal(t, []ResultFile{
+		{Name: "9.log", Size: 900},
+		{Name: "10.log", Size: 1000},
+		{Name: "100.log", Size: 100},
+	}, files.Files)
+
+	var pair ResultGroup
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/pair", &pair))
+	assert.Equal(t, []ResultFile{{Name: "9.log", Size: 900}, {Name: "100.log", Size: 100}}, pair.Files)
+	if assert.NotNil(t, pair.Plan) {
+		assert.Equal(t, StrategyStream, pair.Plan.Strategy)
+		assert.Equal(t, int64(1000), pair.Plan.BytesRead)
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodPost, "/files", nil))
+
+	// The swap is started in the background
+	assert.Equal(t, http.StatusAccepted, request(http.MethodPost, "/swap", &status))
+	assert.Equal(t, SwapStateRunning, status.State)
+	assert.NotNil(t, status.StartedAt)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for status.State != SwapStateFinished && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, http.StatusOK, request(http.MethodGet, "/swap", &status))
+	}
+	assert.Equal(t, SwapStateFinished, status.State)
+	assert.NotNil(t, status.FinishedAt)
+	if assert.NotNil(t, status.Progress) {
+		assert.Equal(t, int64(1000), status.Progress.Done)
+		assert.Equal(t, int64(1000), status.Progress.Total)
+	}
+
+	var result RunResult
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/result", &result))
+	assert.Nil(t, result.Error)
+	assert.Equal(t, StrategyStream, result.Strategy)
+	if assert.Len(t, result.Groups, 1) {
+		firstChecksum, _ := fileChecksum(file_system.OS, dir+"9.log")
+		assert.Equal(t, ResultFile{Name: "9.log", Size: 900, SHA256: firstChecksum}, result.Groups[0].Files[0])
+	}
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsData, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(metricsData), `swap_runs_total{operation="swap"} 1`)
+	assert.Contains(t, string(metricsData), "swap_read_bytes_total 1000\n")
+
+	firstOutData, _ := os.ReadFile(dir + "9.log")
+	assert.Equal(t, filesData["100.log"], firstOutData)
+	secondOutData, _ := os.ReadFile(dir + "100.log")
+	assert.Equal(t, filesData["9.log"], secondOutData)
+
+	// Only one swap runs at a time
+	s.mu.Lock()
+	s.status.State = SwapStateRunning
+	s.mu.Unlock()
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/swap", &errResp))
+	assert.Equal(t, ErrSwapRunning.Error(), errResp.Error.Message)
+	assert.Equal(t, ErrorCodeBusy, errResp.Error.Code)
+	s.mu.Lock()
+	s.status.State = SwapStateFinished
+	s.mu.Unlock()
+
+	cancel()
+	s.wait()
+}
+
+func TestRunMetrics(t *testing.T) {
+	metrics := newRunMetrics()
+
+	metrics.observe(&RunResult{
+		Operation:    OperationSwap,
+		Strategy:     StrategyStream,
+		Groups:       []ResultGroup{{Files: []ResultFile{{Name: "1.log", Size: 1000}, {Name: "2.log", Size: 3000}}}},
+		BytesRead:    4000,
+		BytesWritten: 4000,
+		Scanned:      10,
+		ScanDuration: 0.01,
+		Duration:     0.5,
+	})
+	metrics.observe(&RunResult{
+		Operation: OperationSwap,
+		Strategy:  StrategyAuto + " (" + StrategyExchange + ")",
+		Groups:    []ResultGroup{{Files: []ResultFile{{Name: "1.log", Size: 3000}, {Name: "2.log", Size: 1000}}}},
+		Scanned:   10,
+	})
+	metrics.observe(&RunResult{
+		Operation:    OperationRotate,
+		BytesRead:    500,
+		BytesWritten: 200,
+		Scanned:      5,
+		Error:        &ResultError{Code: ErrorCodeIO},
+	})
+	// The dry run is not recorded
+	metrics.observe(&RunResult{Operation: OperationSwap, DryRun: true, Scanned: 100})
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.runs.WithLabelValues(OperationSwap)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.runs.WithLabelValues(OperationRotate)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.errors.WithLabelValues(ErrorCodeIO)))
+	assert.Equal(t, 25.0, testutil.ToFloat64(metrics.scannedFiles))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.swappedGroups))
+
+	// The exchange copied no data, the bytes of the failed rotation are counted
+	name := TestFolderPath + "TestRunMetrics.prom"
+	assert.NoError(t, metrics.writeTextfile(name))
+	defer os.Remove(name)
+	data, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "swap_read_bytes_total 4500\n")
+	assert.Contains(t, string(data), "swap_written_bytes_total 4200\n")
+	assert.Contains(t, string(data), `swap_runs_total{operation="swap"} 2`)
+}
+
+func TestLogging(t *testing.T) {
+	_, err := newLogger(io.Discard, "verbose", LogFormatText)
+	assert.ErrorIs(t, err, ErrUnknownLogLevel)
+	_, err = newLogger(io.Discard, "info", "xml")
+	assert.ErrorIs(t, err, ErrUnknownLogFormat)
+
+	dir := TestFolderPath + "TestLogging/"
+	configPath := TestFolderPath + "TestLogging.yml"
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configPath)
+
+	if err := os.WriteFile(dir+"1.log", generateNewLogData(1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"2.log", generateNewLogData2(3000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// readMessages returns the messages of the JSON records
+	readMessages := func(buf *bytes.Buffer) []string {
+		var messages []string
+		scanner := bufio.NewScanner(buf)
+		for scanner.Scan() {
+			var record struct {
+				Msg string `json:"msg"`
+			}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			messages = append(messages, record.Msg)
+		}
+		return messages
+	}
+
+	opts := runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputText,
+		readBlockSize:  64,
+		writeBlockSize: 64,
+	}
+
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "debug", LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := run(context.Background(), file_system.OS, logger, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	messages := readMessages(&buf)
+	for _, msg := range []string{"run started", "scanning directory", "file matched", "files selected", "swap started",
+		"file opened", "recording started", "recording finished", "file truncated", "swap finished, checksums verified",
+		"file closed", "files processed", "run finished"} {
+		assert.Contains(t, messages, msg)
+	}
+
+	// Records below the level are skipped
+	logger, _ = newLogger(&buf, "warn", LogFormatJSON)
+	result = run(context.Background(), file_system.OS, logger, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	assert.Empty(t, readMessages(&buf))
+
+	opts.strategyName = "unknown"
+	result = run(context.Background(), file_system.OS, logger, opts, io.Discard)
+	assert.NotNil(t, result.Error)
+	assert.Equal(t, []string{"run failed"}, readMessages(&buf))
+}
+
+func TestSwapProgress(t *testing.T) {
+	firstFileName := "TestSwapProgress_1.log"
+	secondFileName := "TestSwapProgress_2.log"
+
+	if err := os.WriteFile(TestFolderPath+firstFileName, generateNewLogData(1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(TestFolderPath + firstFileName)
+	if err := os.WriteFile(TestFolderPath+secondFileName, generateNewLogData2(3000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(TestFolderPath + secondFileName)
+
+	// The swaps feed the progress from the context
+	progress := newSwapProgress()
+	ctx := contextWithProgress(context.Background(), progress)
+	assert.NoError(t, SwapTwoFiles(ctx, file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName, 64, 100))
+
+	s := progress.snapshot()
+	assert.Equal(t, int64(4000), s.Total)
+	assert.Equal(t, int64(4000), s.Done)
+	assert.Equal(t, int64(4000), s.Read)
+	assert.Equal(t, 100.0, s.Percent())
+	assert.Equal(t, 0.0, s.ETA)
+
+	_, err := SwapTwoFilesZeroCopy(ctx, file_system.OS, TestFolderPath, firstFileName, secondFileName)
+	assert.NoError(t, err)
+	s = progress.snapshot()
+	// The first file (3000 bytes after the first swap) is copied twice
+	assert.Equal(t, int64(4000+7000), s.Total)
+	assert.Equal(t, s.Total, s.Done)
+
+	// The userspace copy is counted once
+	mem := file_system.NewMemFS()
+	assert.NoError(t, file_system.WriteFile(mem, firstFileName, generateNewLogData(1000), 0600))
+	assert.NoError(t, file_system.WriteFile(mem, secondFileName, generateNewLogData2(3000), 0600))
+	memProgress := newSwapProgress()
+	_, err = SwapTwoFilesZeroCopy(contextWithProgress(context.Background(), memProgress), mem, "", firstFileName, secondFileName)
+	assert.NoError(t, err)
+	s = memProgress.snapshot()
+	assert.Equal(t, int64(5000), s.Total)
+	assert.Equal(t, int64(5000), s.Done)
+	assert.Equal(t, int64(5000), s.Read)
+
+	// A nil progress is not fed
+	assert.NoError(t, SwapTwoFiles(context.Background(), file_system.OS, logging.Discard, TestFolderPath, firstFileName, secondFileName, 64, 100))
+
+	assert.Equal(t, "[###############---------------]  50.0%  8.0 MiB / 16.0 MiB  1.5 MiB/s  ETA 5s ",
+		formatProgressBar(ProgressSnapshot{Done: 8 << 20, Total: 16 << 20, Rate: 1.5 * (1 << 20), ETA: 5.4}))
+	assert.Equal(t, "[------------------------------]   0.0%  0 B / 100 B  0 B/s  ETA ? ",
+		formatProgressBar(ProgressSnapshot{Total: 100, ETA: -1}))
+
+	// The last state is rendered when the reporter is stopped
+	var buf bytes.Buffer
+	stop := startProgressReporter(progress, ProgressBar, &buf, logging.Discard)
+	stop()
+	stop()
+	assert.True(t, strings.HasPrefix(buf.String(), "\r[##############################] 100.0%"))
+	assert.True(t, strings.HasSuffix(buf.String(), "\n"))
+
+	buf.Reset()
+	logger, _ := newLogger(&buf, "info", LogFormatJSON)
+	startProgressReporter(progress, ProgressEvents, io.Discard, logger)()
+	var record struct {
+		Msg       string `json:"msg"`
+		BytesDone int64  `json:"bytes_done"`
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "progress", record.Msg)
+	assert.Equal(t, int64(11000), record.BytesDone)
+
+	assert.Equal(t, ProgressEvents, resolveProgressMode(ProgressAuto, OutputJSON, os.Stdout))
+	assert.Equal(t, ProgressOff, resolveProgressMode(ProgressOff, OutputText, os.Stdout))
+}
+
+func TestInMemoryFS(t *testing.T) {
+	// Only the config is read from the OS filesystem
+	dir := "/TestInMemoryFS/"
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := file_system.NewMemFS()
+	if err := fsys.MkdirAll(dir+"sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	firstFileData := generateNewLogData(1000)
+	secondFileData := generateNewLogData2(3000)
+	writeFiles := func() {
+		for name, data := range map[string][]byte{"1.log": firstFileData, "2.log": []byte("middle"), "3.log": secondFileData, "sub/4.log": nil} {
+			if err := file_system.WriteFile(fsys, dir+name, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	readFile := func(name string) []byte {
+		data, err := file_system.ReadFile(fsys, dir+name)
+		assert.NoError(t, err)
+		return data
+	}
+	// The swaps leave no temporary files, journals and backups
+	assertNoTempFiles := func() {
+		for _, tempDir := range []string{dir, fsys.TempDir()} {
+			entries, err := file_system.ReadDir(fsys, tempDir)
+			assert.NoError(t, err)
+			for _, entry := range entries {
+				assert.False(t, strings.HasPrefix(entry.Name(), "."), entry.Name())
+			}
+		}
+	}
+
+	opts := runOptions{
+		configPath:     configPath,
+		recursiveMode:  RecursiveOff,
+		output:         OutputJSON,
+		readBlockSize:  64,
+		writeBlockSize: 100,
+	}
+
+	for _, tc := range []struct {
+		strategy string
+		journal  bool
+		used     string
+	}{
+		{StrategyStream, false, StrategyStream},
+		{StrategyStream, true, StrategyStream},
+		{StrategyRename, false, StrategyRename},
+		{StrategyZeroCopy, false, StrategyZeroCopy + " (userspace)"},
+		{StrategyAuto, false, StrategyAuto + " (" + StrategyRename + ")"},
+	} {
+		t.Run(fmt.Sprint(tc.strategy, " journal ", tc.journal), func(t *testing.T) {
+			writeFiles()
+			opts.strategyName, opts.journal = tc.strategy, tc.journal
+
+			result := run(context.Background(), fsys, logging.Discard, opts, io.Discard)
+			if !assert.Nil(t, result.Error) {
+				return
+			}
+			assert.Equal(t, tc.used, result.Strategy)
+			assert.Equal(t, secondFileData, readFile("1.log"))
+			assert.Equal(t, firstFileData, readFile("3.log"))
+			if assert.Len(t, result.Groups, 1) {
+				firstChecksum, _ := fileChecksum(fsys, dir+"1.log")
+				assert.Equal(t, ResultFile{Name: "1.log", Size: 1000, SHA256: firstChecksum}, result.Groups[0].Files[0])
+			}
+			assertNoTempFiles()
+		})
+	}
+
+	// The atomic exchange needs the OS filesystem
+	opts.strategyName, opts.journal = StrategyExchange, false
+	result := run(context.Background(), fsys, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Contains(t, result.Error.Message, ErrExchangeNotSupported.Error())
+	}
+
+	opts.strategyName = StrategyStream
+	opts.metadata = MetadataKeep
+	result = run(context.Background(), fsys, logging.Discard, opts, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeConfig, result.Error.Code)
+	}
+	opts.metadata = ""
+
+	// Rotation and the recursive scan
+	writeFiles()
+	opts.rotate = true
+	assert.Nil(t, run(context.Background(), fsys, logging.Discard, opts, io.Discard).Error)
+	assert.Equal(t, []byte("middle"), readFile("1.log"))
+	assert.Equal(t, secondFileData, readFile("2.log"))
+	assert.Equal(t, firstFileData, readFile("3.log"))
+
+	writeFiles()
+	opts.rotate, opts.recursiveMode = false, RecursiveGlobal
+	assert.Nil(t, run(context.Background(), fsys, logging.Discard, opts, io.Discard).Error)
+	assert.Equal(t, firstFileData, readFile("sub/4.log"))
+	assert.Empty(t, readFile("1.log"))
+	assertNoTempFiles()
+
+	// The dry run and the plan
+	opts.recursiveMode, opts.dryRun = RecursiveOff, true
+	result = run(context.Background(), fsys, logging.Discard, opts, io.Discard)
+	if assert.Nil(t, result.Error) && assert.Len(t, result.Groups, 1) {
+		assert.Empty(t, result.Groups[0].Plan.Warnings)
+	}
+
+	// An interrupted swap is recovered from the journal
+	writeFiles()
+	_, err := beginJournal(context.Background(), fsys, filepath.Clean(dir), []string{dir + "1.log", dir + "3.log"}, []int{1, 0})
+	assert.NoError(t, err)
+	interrupted, err := FindInterruptedSwaps(context.Background(), fsys, logging.Discard, dir, SelectOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Clean(dir)}, interrupted)
+	opts.dryRun = false
+	result = run(context.Background(), fsys, logging.Discard, opts, io.Discard)
+	assert.Nil(t, result.Error)
+	assert.Equal(t, 1, result.Recovered)
+	// The recovered swap is swapped back by the run
+	assert.Equal(t, firstFileData, readFile("1.log"))
+	assert.Equal(t, secondFileData, readFile("3.log"))
+	assertNoTempFiles()
+
+	// Nothing is created on the OS filesystem
+	_, err = os.Stat(dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRenameCrossDevice(t *testing.T) {
+	dir := "/TestRenameCrossDevice/"
+	firstFileData := generateNewLogData(1000)
+	secondFileData := generateNewLogData2(3000)
+
+	// The second rename of the sequence fails as if the files were on different filesystems
+	newFS := func() (*file_system.MemFS, *file_system.FaultFS) {
+		mem := file_system.NewMemFS()
+		if err := mem.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := file_system.WriteFile(mem, dir+"1.log", firstFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := file_system.WriteFile(mem, dir+"2.log", secondFileData, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return mem, file_system.NewFaultFS(mem, &file_system.Fault{Op: file_system.OpRename, Name: "2.log", Repeat: true, Err: syscall.EXDEV})
+	}
+
+	assertFiles := func(mem *file_system.MemFS, first, second []byte) {
+		firstOutData, err := file_system.ReadFile(mem, dir+"1.log")
+		assert.NoError(t, err)
+		assert.Equal(t, first, firstOutData)
+		secondOutData, err := file_system.ReadFile(mem, dir+"2.log")
+		assert.NoError(t, err)
+		assert.Equal(t, second, secondOutData)
+
+		// The journal and the temporary name are removed
+		leftovers, err := file_system.Glob(mem, dir, ".swap*")
+		assert.NoError(t, err)
+		assert.Empty(t, leftovers)
+	}
+
+	// The first rename is undone
+	mem, fsys := newFS()
+	err := renameStrategy{}.Swap(context.Background(), fsys, logging.Discard, dir, "1.log", "2.log")
+	assert.ErrorIs(t, err, syscall.EXDEV)
+	assertFiles(mem, firstFileData, secondFileData)
+
+	// The auto strategy copies the files instead
+	mem, fsys = newFS()
+	strategy, err := NewSwapStrategy(StrategyAuto, 64, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, strategy.Swap(context.Background(), fsys, logging.Discard, dir, "1.log", "2.log"))
+	assert.Equal(t, StrategyAuto+" ("+StrategyZeroCopy+" (userspace))", strategy.Name())
+	assertFiles(mem, secondFileData, firstFileData)
+
+	// The recovery discards the swap that can't be finished
+	mem, fsys = newFS()
+	if _, err = beginRenameJournal(fsys, filepath.Clean(dir), dir+"1.log", dir+"2.log"); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := RecoverSwap(context.Background(), fsys, logging.Discard, filepath.Clean(dir))
+	assert.NoError(t, err)
+	assert.True(t, recovered)
+	assertFiles(mem, firstFileData, secondFileData)
+}
+
+func TestSwapFaults(t *testing.T) {
+	dir := "/TestSwapFaults/"
+	names := []string{"1.log", "2.log", "3.log"}
+	original := [][]byte{generateNewLogData(1000), generateNewLogData(2000), generateNewLogData2(3000)}
+
+	operations := []struct {
+		name    string
+		swap    func(fsys file_system.FS) error
+		files   []int // Indexes of the processed files
+		sources []int // The processed file i receives the original content of names[sources[i]]
+		journal bool
+	}{
+		{"stream", func(fsys file_system.FS) error {
+			return SwapTwoFiles(context.Background(), fsys, logging.Discard, dir, names[0], names[2], 64, 100)
+		}, []int{0, 2}, []int{2, 0}, false},
+		{"journal", func(fsys file_system.FS) error {
+			return SwapTwoFilesJournaled(context.Background(), fsys, logging.Discard, dir, names[0], names[2], 64, 100)
+		}, []int{0, 2}, []int{2, 0}, true},
+		{"zerocopy", func(fsys file_system.FS) error {
+			_, err := SwapTwoFilesZeroCopy(context.Background(), fsys, dir, names[0], names[2])
+			return err
+		}, []int{0, 2}, []int{2, 0}, false},
+		{"rotate", func(fsys file_system.FS) error {
+			return RotateFiles(context.Background(), fsys, dir, names)
+		}, []int{0, 1, 2}, []int{1, 2, 0}, true},
+	}
+
+	faults := map[string]file_system.Fault{
+		"read of the first file":         {Op: file_system.OpRead, Name: "1.log", Offset: 500},
+		"short read of the second file":  {Op: file_system.OpRead, Name: "3.log", Offset: 1500, Short: true},
+		"read by the call count":         {Op: file_system.OpRead, Call: 7},
+		"write of the first file":        {Op: file_system.OpWrite, Name: "1.log", Offset: 700},
+		"short write of the second file": {Op: file_system.OpWrite, Name: "3.log", Offset: 300, Short: true},
+		"short write by the call count":  {Op: file_system.OpWrite, Call: 5, Short: true},
+		"full disk":                      {Op: file_system.OpWrite, Name: "1.log", Offset: 1000, Repeat: true, Short: true, Err: syscall.ENOSPC},
+		"write of the undo file":         {Op: file_system.OpWrite, Name: ".swap-undo-*", Offset: 100},
+		"write of the stage file":        {Op: file_system.OpWrite, Name: ".swap-stage-*", Offset: 200, Err: syscall.ENOSPC},
+		"write of a backup":              {Op: file_system.OpWrite, Name: journalFileName + ".*.bak", Offset: 100},
+		"save of the journal":            {Op: file_system.OpWrite, Name: journalFileName + ".tmp", Call: 2},
+		"truncate of the first file":     {Op: file_system.OpTruncate, Name: "1.log"},
+		"truncate of the second file":    {Op: file_system.OpTruncate, Name: "3.log"},
+		"sync of a file":                 {Op: file_system.OpSync, Name: "*.log"},
+		"corrupted write":                {Op: file_system.OpWrite, Name: "3.log", Corrupt: true},
+	}
+
+	for faultName, fault := range faults {
+		for _, operation := range operations {
+			fault := fault
+			t.Run(operation.name+" "+faultName, func(t *testing.T) {
+				mem := file_system.NewMemFS()
+				if err := mem.MkdirAll(dir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				for i, name := range names {
+					if err := file_system.WriteFile(mem, dir+name, original[i], 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				fsys := file_system.NewFaultFS(mem, &fault)
+				err := operation.swap(fsys)
+
+				// An injected fault is never ignored
+				fired := fsys.Fired(&fault) > 0
+				if fired {
+					expected := fault.Err
+					switch {
+					case fault.Corrupt:
+						expected = ErrChecksumMismatch
+					case expected == nil:
+						expected = syscall.EIO
+					}
+					assert.ErrorIs(t, err, expected)
+				} else {
+					assert.NoError(t, err)
+				}
+
+				// A journaled swap that failed is rolled back, there is nothing to recover
+				if operation.journal {
+					recovered, recoverErr := RecoverSwap(context.Background(), fsys, logging.Discard, filepath.Clean(dir))
+					assert.NoError(t, recoverErr)
+					assert.False(t, recovered)
+				}
+
+				// Every file has either the original or the new content, all files are in the same state
+				var swapped, restored int
+				for i, file := range operation.files {
+					data, readErr := file_system.ReadFile(mem, dir+names[file])
+					assert.NoError(t, readErr)
+					switch {
+					case bytes.Equal(data, original[operation.sources[i]]):
+						swapped++
+					case bytes.Equal(data, original[file]):
+						restored++
+					default:
+						t.Errorf("%s is corrupted: %d bytes", names[file], len(data))
+					}
+				}
+				switch {
+				case err == nil:
+					assert.Equal(t, len(operation.files), swapped)
+				default:
+					assert.Equal(t, len(operation.files), restored)
+				}
+
+				// The undo files, the stage file, the journal and the backups are removed
+				for _, tempDir := range []string{dir, mem.TempDir()} {
+					entries, readErr := file_system.ReadDir(mem, tempDir)
+					assert.NoError(t, readErr)
+					for _, entry := range entries {
+						assert.False(t, strings.HasPrefix(entry.Name(), "."), entry.Name())
+					}
+				}
+			})
+		}
+	}
+
+	// The run fails with the I/O error
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(configPath, []byte("path_to_files: "+dir+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mem := file_system.NewMemFS()
+	if err := mem.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		if err := file_system.WriteFile(mem, dir+name, original[i], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := file_system.NewFaultFS(mem, &file_system.Fault{Op: file_system.OpWrite, Name: "1.log", Offset: 1000, Repeat: true, Err: syscall.ENOSPC})
+	result := run(context.Background(), fsys, logging.Discard, runOptions{
+		configPath:     configPath,
+		strategyName:   StrategyStream,
+		recursiveMode:  RecursiveOff,
+		output:         OutputJSON,
+		readBlockSize:  64,
+		writeBlockSize: 100,
+	}, io.Discard)
+	if assert.NotNil(t, result.Error) {
+		assert.Equal(t, ErrorCodeIO, result.Error.Code)
+		assert.Contains(t, result.Error.Message, syscall.ENOSPC.Error())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Metadata modes.
+const (
+	// MetadataKeep restores the metadata of every file after the swap, so it stays with the file name.
+	MetadataKeep = "keep"
+	// MetadataSwap moves the metadata along with the content.
+	MetadataSwap = "swap"
+)
+
+var ErrUnknownMetadataMode = errors.New("unknown metadata mode (keep or swap)")
+
+// fileMetadata is the metadata of a file that is kept or swapped: permissions, ownership,
+// access and modification times and extended attributes.
+// Ownership and extended attributes are supported on Linux only.
+type fileMetadata struct {
+	mode         os.FileMode
+	uid, gid     int
+	hasOwner     bool
+	atime, mtime time.Time
+	xattrs       map[string][]byte
+}
+
+// readMetadata reads the metadata of the file.
+func readMetadata(name string) (*fileMetadata, error) {
+	fileStats, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &fileMetadata{
+		mode:  fileStats.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		atime: fileAtime(fileStats),
+		mtime: fileStats.ModTime(),
+	}
+	m.uid, m.gid, m.hasOwner = fileOwner(fileStats)
+
+	if m.xattrs, err = listXattrs(name); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// apply sets the metadata of the file. The owner is changed only if it's permitted.
+func (m *fileMetadata) apply(name string) error {
+	// Changing the owner clears the setuid and setgid bits, so it's done before chmod
+	if m.hasOwner {
+		if err := os.Chown(name, m.uid, m.gid); err != nil && !errors.Is(err, os.ErrPermission) {
+			return err
+		}
+	}
+	if err := os.Chmod(name, m.mode); err != nil {
+		return err
+	}
+	if err := setXattrs(name, m.xattrs); err != nil {
+		return err
+	}
+	// Times are set last, because the other changes may update them
+	return os.Chtimes(name, m.atime, m.mtime)
+}
+
+// captureMetadata reads the metadata of the files before the swap or the rotation.
+func captureMetadata(path string, names []string) ([]*fileMetadata, error) {
+	metadata := make([]*fileMetadata, len(names))
+	for i, name := range names {
+		m, err := readMetadata(path + name)
+		if err != nil {
+			return nil, err
+		}
+		metadata[i] = m
+	}
+	return metadata, nil
+}
+
+// restoreMetadata sets the metadata captured before the swap or the rotation of the files.
+// With MetadataKeep every file gets its own metadata back, with MetadataSwap it gets the metadata of
+// the file whose content it received: the next one, the last file receives the content of the first one.
+// A failure doesn't stop the restoring of the other files, the errors of all files are returned.
+func restoreMetadata(mode, path string, names []string, metadata []*fileMetadata) error {
+	var errs []error
+	for i, name := range names {
+		source := i
+		if mode == MetadataSwap {
+			source = (i + 1) % len(names)
+		}
+		if err := metadata[source].apply(path + name); err != nil {
+			errs = append(errs, fmt.Errorf("cannot set the metadata of %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
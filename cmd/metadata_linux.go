@@ -0,0 +1,135 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileAtime returns the access time of the file.
+func fileAtime(fileStats os.FileInfo) time.Time {
+	if stats, ok := fileStats.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stats.Atim.Unix())
+	}
+	return fileStats.ModTime()
+}
+
+// fileOwner returns the user and the group of the file.
+func fileOwner(fileStats os.FileInfo) (uid, gid int, ok bool) {
+	if stats, ok := fileStats.Sys().(*syscall.Stat_t); ok {
+		return int(stats.Uid), int(stats.Gid), true
+	}
+	return 0, 0, false
+}
+
+// listXattrs returns the extended attributes of the file.
+// If the filesystem doesn't support them, the result is empty.
+func listXattrs(name string) (map[string][]byte, error) {
+	names, err := xattrNames(name)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte, len(names))
+	for _, attr := range names {
+		value, err := xattrValue(name, attr)
+		if errors.Is(err, unix.ENODATA) {
+			// Removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+		attrs[attr] = value
+	}
+	return attrs, nil
+}
+
+func xattrNames(name string) ([]string, error) {
+	for {
+		size, err := unix.Listxattr(name, nil)
+		if err == nil && size > 0 {
+			buf := make([]byte, size)
+			size, err = unix.Listxattr(name, buf)
+			if err == nil {
+				return splitXattrNames(buf[:size]), nil
+			}
+		}
+		switch {
+		case errors.Is(err, unix.ERANGE):
+			// The list grew between the calls
+			continue
+		case errors.Is(err, unix.ENOTSUP):
+			return nil, nil
+		case err != nil:
+			return nil, &os.PathError{Op: "listxattr", Path: name, Err: err}
+		}
+		return nil, nil
+	}
+}
+
+func splitXattrNames(buf []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
+
+func xattrValue(name, attr string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(name, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Getxattr(name, attr, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
+
+// setXattrs replaces the extended attributes of the file with attrs.
+// Attributes that can't be changed without privileges (trusted.*, security.*) are skipped.
+func setXattrs(name string, attrs map[string][]byte) error {
+	current, err := xattrNames(name)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range current {
+		if _, ok := attrs[attr]; ok {
+			continue
+		}
+		if err = unix.Removexattr(name, attr); err != nil && !skippableXattrError(err) {
+			return &os.PathError{Op: "removexattr", Path: name, Err: err}
+		}
+	}
+
+	for attr, value := range attrs {
+		if err = unix.Setxattr(name, attr, value, 0); err != nil && !skippableXattrError(err) {
+			return &os.PathError{Op: "setxattr", Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+func skippableXattrError(err error) bool {
+	return errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.ENODATA)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileAtime is supported on Linux only, the modification time is returned.
+func fileAtime(fileStats os.FileInfo) time.Time {
+	return fileStats.ModTime()
+}
+
+// fileOwner is supported on Linux only.
+func fileOwner(_ os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// listXattrs is supported on Linux only.
+func listXattrs(_ string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setXattrs is supported on Linux only.
+func setXattrs(_ string, _ map[string][]byte) error {
+	return nil
+}
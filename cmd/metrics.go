@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// runMetrics are the Prometheus metrics of the runs. They are exposed by /metrics in the serve and watch modes
+// and written to a file for the textfile collector of the node exporter after a one-shot run.
+type runMetrics struct {
+	registry *prometheus.Registry
+
+	runs          *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	bytesRead     prometheus.Counter
+	bytesWritten  prometheus.Counter
+	scanDuration  prometheus.Histogram
+	scannedFiles  prometheus.Counter
+	lastSuccess   prometheus.Gauge
+	swappedGroups prometheus.Counter
+}
+
+func newRunMetrics() *runMetrics {
+	m := &runMetrics{
+		registry: prometheus.NewRegistry(),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "swap_runs_total",
+			Help: "Number of runs by the operation (swap or rotate).",
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "swap_errors_total",
+			Help: "Number of failed runs by the error code.",
+		}, []string{"code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "swap_duration_seconds",
+			Help:    "Duration of the runs including the selection of the files.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"operation"}),
+		bytesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "swap_read_bytes_total",
+			Help: "Bytes read by the swaps including the backups of the journal.",
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "swap_written_bytes_total",
+			Help: "Bytes written by the swaps including the backups of the journal.",
+		}),
+		scanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "swap_selection_scan_duration_seconds",
+			Help:    "Duration of the selection of the files.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		scannedFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "swap_selection_scanned_files_total",
+			Help: "Number of the directory entries scanned by the selection of the files.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "swap_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful run.",
+		}),
+		swappedGroups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "swap_groups_total",
+			Help: "Number of swapped pairs and rotated sets of files.",
+		}),
+	}
+
+	m.registry.MustRegister(m.runs, m.errors, m.duration, m.bytesRead, m.bytesWritten,
+		m.scanDuration, m.scannedFiles, m.lastSuccess, m.swappedGroups)
+	return m
+}
+
+// observe records the result of the run. The dry run is not recorded.
+func (m *runMetrics) observe(result *RunResult) {
+	if m == nil || result.DryRun {
+		return
+	}
+
+	m.runs.WithLabelValues(result.Operation).Inc()
+	m.duration.WithLabelValues(result.Operation).Observe(result.Duration)
+	m.scanDuration.Observe(result.ScanDuration)
+	m.scannedFiles.Add(float64(result.Scanned))
+	// The bytes transferred before an error are counted too
+	m.bytesRead.Add(float64(result.BytesRead))
+	m.bytesWritten.Add(float64(result.BytesWritten))
+
+	if result.Error != nil {
+		m.errors.WithLabelValues(result.Error.Code).Inc()
+		return
+	}
+	m.lastSuccess.SetToCurrentTime()
+
+	m.swappedGroups.Add(float64(len(result.Groups)))
+}
+
+// handler returns the handler of /metrics.
+func (m *runMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// writeTextfile writes the metrics to the file in the text format of the textfile collector.
+// The file is replaced atomically.
+func (m *runMetrics) writeTextfile(name string) error {
+	return prometheus.WriteToTextfile(name, m.registry)
+}
+
+// serveMetrics serves /metrics on the address in the background and returns the function that stops the server.
+func serveMetrics(addr string, metrics *runMetrics) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"TestTask/pkg/file_lock"
+	"TestTask/pkg/file_system"
+)
+
+// Output formats.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Operations of the run.
+const (
+	OperationSwap   = "swap"
+	OperationRotate = "rotate"
+)
+
+// Error codes of the run result.
+const (
+	ErrorCodeConfig         = "config"
+	ErrorCodeNoFiles        = "no_files"
+	ErrorCodeNotEnoughFiles = "not_enough_files"
+	ErrorCodeIO             = "io"
+	ErrorCodeLocked         = "locked"
+	ErrorCodeCanceled       = "canceled"
+	ErrorCodeTimeout        = "timeout"
+
+	// Errors of the API that are not results of a run, so they have no exit codes
+	ErrorCodeNoResult = "no_result" // No swap has finished yet
+	ErrorCodeBusy     = "busy"      // A swap started by the API is running
+)
+
+// Process exit codes. Invalid flags are reported by the flag package with ExitConfig as well.
+const (
+	ExitOK             = 0
+	ExitConfig         = 2
+	ExitNoFiles        = 3
+	ExitNotEnoughFiles = 4
+	ExitIO             = 5
+	ExitLocked         = 6
+	ExitTimeout        = 124
+	ExitCanceled       = 130
+)
+
+var exitCodes = map[string]int{
+	ErrorCodeConfig:         ExitConfig,
+	ErrorCodeNoFiles:        ExitNoFiles,
+	ErrorCodeNotEnoughFiles: ExitNotEnoughFiles,
+	ErrorCodeIO:             ExitIO,
+	ErrorCodeLocked:         ExitLocked,
+	ErrorCodeCanceled:       ExitCanceled,
+	ErrorCodeTimeout:        ExitTimeout,
+}
+
+var ErrUnknownOutput = errors.New("unknown output format")
+
+// RunResult is the machine-readable result of a run printed with -output json.
+type RunResult struct {
+	Operation string        `json:"operation"`
+	DryRun    bool          `json:"dry_run"`
+	Strategy  string        `json:"strategy,omitempty"`
+	Groups    []ResultGroup `json:"groups"`
+	// Total size of the swapped files
+	Bytes int64 `json:"bytes"`
+	// Bytes read and written by the swaps including the backups of the journal,
+	// 0 if the strategy swaps the directory entries
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+	// Number of recovered interrupted swaps and, in the dry run, the directories with them
+	Recovered   int      `json:"recovered"`
+	Interrupted []string `json:"interrupted,omitempty"`
+	// Number of the directory entries scanned by the selection of the files and its duration in seconds
+	Scanned      int     `json:"scanned"`
+	ScanDuration float64 `json:"scan_duration"`
+	// Warnings that are not related to a planned group: the locked directory of the dry run, the skipped files,
+	// the stage files of the interrupted zerocopy swaps and the metadata that wasn't restored after the swap
+	Warnings []string `json:"warnings,omitempty"`
+	// Duration in seconds
+	Duration float64      `json:"duration"`
+	Error    *ResultError `json:"error,omitempty"`
+}
+
+// ResultGroup is a pair of swapped files or a set of rotated files.
+type ResultGroup struct {
+	Files []ResultFile `json:"files"`
+	Plan  *SwapPlan    `json:"plan,omitempty"`
+}
+
+// ResultFile describes a file before the swap. SHA256 is the checksum of the new content.
+type ResultFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type ResultError struct {
+	Code     string `json:"code"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Message  string `json:"message"`
+}
+
+func newResultError(code string, err error) *ResultError {
+	return &ResultError{Code: code, ExitCode: exitCodes[code], Message: err.Error()}
+}
+
+func (r *RunResult) fail(code string, err error) {
+	r.Error = newResultError(code, err)
+}
+
+// setTransferred sets the bytes read and written by the swaps from the progress of the run.
+func (r *RunResult) setTransferred(progress *swapProgress) {
+	if progress != nil {
+		r.BytesRead = progress.read.Load()
+		r.BytesWritten = progress.written.Load()
+	}
+}
+
+// errorCode returns the error code of the error of the file selection or processing.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorCodeTimeout
+	case errors.Is(err, ErrNoFiles):
+		return ErrorCodeNoFiles
+	case errors.Is(err, ErrNotEnoughFiles):
+		return ErrorCodeNotEnoughFiles
+	case errors.Is(err, file_lock.ErrLocked):
+		return ErrorCodeLocked
+	case errors.Is(err, ErrInvalidPattern):
+		return ErrorCodeConfig
+	default:
+		return ErrorCodeIO
+	}
+}
+
+func newResultGroup(fsys file_system.FS, path string, names []string) (ResultGroup, error) {
+	group := ResultGroup{Files: []ResultFile{}}
+	for _, name := range names {
+		fileStats, err := fsys.Stat(path + name)
+		if err != nil {
+			return group, err
+		}
+		group.Files = append(group.Files, ResultFile{Name: name, Size: fileStats.Size()})
+	}
+	return group, nil
+}
+
+func newPlannedGroup(plan *SwapPlan) ResultGroup {
+	group := ResultGroup{Plan: plan}
+	for _, file := range plan.Files {
+		group.Files = append(group.Files, ResultFile{Name: file.Name, Size: file.Size})
+	}
+	return group
+}
+
+func (g *ResultGroup) totalSize() int64 {
+	var size int64
+	for _, file := range g.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// computeChecksums fills the SHA-256 checksums of the current content of the files.
+func (g *ResultGroup) computeChecksums(fsys file_system.FS, path string) error {
+	for i := range g.Files {
+		sum, err := fileChecksum(fsys, path+g.Files[i].Name)
+		if err != nil {
+			return err
+		}
+		g.Files[i].SHA256 = sum
+	}
+	return nil
+}
+
+func fileChecksum(fsys file_system.FS, name string) (string, error) {
+	sum, err := fileSHA256(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// fileSHA256 returns the SHA-256 of the file content.
+func fileSHA256(fsys file_system.FS, name string) ([]byte, error) {
+	f, err := file_system.Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readerSHA256(f)
+}
+
+func readerSHA256(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func writeRunResult(w io.Writer, result *RunResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// pipelineDepth is the number of blocks that can be queued between the reader and a writer.
+// It bounds the memory used by a swap to about 2*pipelineDepth blocks.
+const pipelineDepth = 8
+
+// blockPool reuses the blocks passed from the reader to the writers.
+type blockPool struct {
+	pool sync.Pool
+}
+
+func newBlockPool(blockSize int) *blockPool {
+	p := &blockPool{}
+	p.pool.New = func() interface{} {
+		block := make([]byte, blockSize)
+		return &block
+	}
+	return p
+}
+
+// Get returns a block of the full size.
+func (p *blockPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *blockPool) Put(block *[]byte) {
+	*block = (*block)[:cap(*block)]
+	p.pool.Put(block)
+}
+
+// swapError keeps the first error of the goroutines of a swap and cancels the others.
+type swapError struct {
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func (e *swapError) Set(err error) {
+	if err == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+		e.cancel()
+	}
+}
+
+func (e *swapError) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// BlockRecordingToFile writes blocks received from chan to a file sequentially from the beginning.
+// The data is written in chunks of writeBlockSize bytes, the blocks are returned to the pool.
+// If snapshot is not nil, the region of the file is saved into it before being overwritten.
+// Writing is stopped if the context is canceled.
+func BlockRecordingToFile(ctx context.Context, logger *slog.Logger, dstFile io.WriterAt, snapshot *fileSnapshot, blocks <-chan *[]byte, pool *blockPool, writeBlockSize int) error {
+	var chIndex int64
+	buf := make([]byte, writeBlockSize)
+	buffered := 0
+
+	logger.Debug("recording started", "write_block_size", writeBlockSize)
+	progress := progressFromContext(ctx)
+
+	writeBlock := func(block []byte) error {
+		if snapshot != nil {
+			if err := snapshot.Save(chIndex, len(block)); err != nil {
+				return err
+			}
+		}
+		if _, err := dstFile.WriteAt(block, chIndex); err != nil {
+			logger.Debug("recording failed", "offset", chIndex, "error", err)
+			return err
+		}
+		chIndex += int64(len(block))
+		progress.addWritten(int64(len(block)))
+		return nil
+	}
+
+	for {
+		var block *[]byte
+		var ok bool
+
+		select {
+		case <-ctx.Done():
+			logger.Debug("recording canceled", "offset", chIndex)
+			return ctx.Err()
+		case block, ok = <-blocks:
+		}
+		if !ok {
+			break
+		}
+
+		data := *block
+		for len(data) > 0 {
+			n := copy(buf[buffered:], data)
+			buffered += n
+			data = data[n:]
+
+			if buffered == writeBlockSize {
+				if err := writeBlock(buf); err != nil {
+					return err
+				}
+				buffered = 0
+			}
+		}
+		pool.Put(block)
+	}
+
+	if buffered > 0 {
+		if err := writeBlock(buf[:buffered]); err != nil {
+			return err
+		}
+	}
+	logger.Debug("recording finished", "written", chIndex)
+	return nil
+}
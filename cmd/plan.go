@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"TestTask/pkg/file_system"
+)
+
+// SwapPlan describes a swap or a rotation without making it.
+type SwapPlan struct {
+	Files    []PlannedFile `json:"-"`
+	Strategy string        `json:"strategy"`
+
+	// Estimated I/O
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+	// Additional disk space required during the swap in the directory of the files and in the temporary directory
+	ExtraSpace int64 `json:"extra_space"`
+	TempSpace  int64 `json:"temp_space"`
+
+	Warnings []string `json:"warnings"`
+
+	fs       file_system.FS
+	dir      string
+	paths    []string
+	stats    []os.FileInfo
+	sameDevs bool
+	symlinks bool // Any of the files is a symlink
+}
+
+type PlannedFile struct {
+	Name string
+	Size int64
+}
+
+func (p *SwapPlan) warn(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (p *SwapPlan) totalSize() int64 {
+	var size int64
+	for _, file := range p.Files {
+		size += file.Size
+	}
+	return size
+}
+
+// PlanSwap describes the swap of two files of the filesystem by the strategy. The files are not modified.
+func PlanSwap(fsys file_system.FS, strategy SwapStrategy, path, firstName, secondName string) (*SwapPlan, error) {
+	plan, err := newSwapPlan(fsys, path, []string{firstName, secondName})
+	if err != nil {
+		return nil, err
+	}
+
+	plan.checkDistinctFiles()
+	strategy.Estimate(plan)
+	plan.checkSpace()
+	return plan, nil
+}
+
+// PlanRotation describes the rotation of the files made by RotateFiles. The files are not modified.
+func PlanRotation(fsys file_system.FS, path string, names []string) (*SwapPlan, error) {
+	plan, err := newSwapPlan(fsys, path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Strategy = "rotation"
+	plan.checkDistinctFiles()
+	plan.checkFilesAccess()
+	plan.checkDirAccess()
+
+	// The files are copied to the backups and then the backups are copied to the files
+	plan.BytesRead = plan.totalSize() * 2
+	plan.BytesWritten = plan.totalSize() * 2
+	plan.ExtraSpace = plan.totalSize() + plan.maxGrowth()
+
+	plan.checkSpace()
+	return plan, nil
+}
+
+func newSwapPlan(fsys file_system.FS, path string, names []string) (*SwapPlan, error) {
+	plan := &SwapPlan{
+		fs:       fsys,
+		dir:      filepath.Dir(path + names[0]),
+		sameDevs: true,
+	}
+
+	for _, name := range names {
+		fileStats, err := fsys.Stat(path + name)
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Files = append(plan.Files, PlannedFile{Name: name, Size: fileStats.Size()})
+		plan.paths = append(plan.paths, path+name)
+		plan.stats = append(plan.stats, fileStats)
+		if !sameDevice(plan.stats[0], fileStats) {
+			plan.sameDevs = false
+		}
+
+		if linkStats, err := fsys.Lstat(path + name); err == nil && linkStats.Mode()&os.ModeSymlink != 0 {
+			plan.symlinks = true
+		}
+	}
+
+	return plan, nil
+}
+
+// maxGrowth returns the biggest increase in size of a file during the swap.
+// Files are truncated after the whole content is written, so a smaller file temporarily grows.
+func (p *SwapPlan) maxGrowth() int64 {
+	var minSize, maxSize int64 = -1, 0
+	for _, file := range p.Files {
+		if minSize < 0 || file.Size < minSize {
+			minSize = file.Size
+		}
+		if file.Size > maxSize {
+			maxSize = file.Size
+		}
+	}
+	return maxSize - minSize
+}
+
+// checkDistinctFiles warns if any two of the files are hard links to the same file, such files are skipped.
+func (p *SwapPlan) checkDistinctFiles() {
+	if err := checkDistinctFiles(p.fs, p.paths...); err != nil {
+		p.warn("%s, the files are skipped", err)
+	}
+}
+
+// checkFilesAccess warns if the files can't be opened for reading and writing.
+func (p *SwapPlan) checkFilesAccess() {
+	for i, file := range p.Files {
+		f, err := p.fs.OpenFile(p.paths[i], os.O_RDWR, 0)
+		if err != nil {
+			p.warn("cannot open %s for reading and writing: %s", file.Name, err)
+			continue
+		}
+		_ = f.Close()
+	}
+}
+
+// checkDirAccess warns if the directories of the files don't allow to create, rename and remove files.
+// The permissions are checked on the OS filesystem only.
+func (p *SwapPlan) checkDirAccess() {
+	if !file_system.IsOS(p.fs) {
+		return
+	}
+
+	checked := map[string]bool{}
+	for _, name := range p.paths {
+		dir := filepath.Dir(name)
+		if checked[dir] {
+			continue
+		}
+		checked[dir] = true
+
+		if err := dirWritable(dir); err != nil {
+			p.warn("cannot modify the directory %s: %s", dir, err)
+		}
+	}
+}
+
+// checkSpace warns if the free space is insufficient. The free space is known on the OS filesystem only.
+func (p *SwapPlan) checkSpace() {
+	if !file_system.IsOS(p.fs) {
+		return
+	}
+
+	if p.ExtraSpace > 0 {
+		if free, err := freeSpace(p.dir); err != nil {
+			p.warn("cannot get the free space in %s: %s", p.dir, err)
+		} else if free < p.ExtraSpace {
+			p.warn("insufficient disk space in %s: %d bytes required, %d bytes available", p.dir, p.ExtraSpace, free)
+		}
+	}
+
+	if p.TempSpace > 0 {
+		tempDir := os.TempDir()
+		if free, err := freeSpace(tempDir); err != nil {
+			p.warn("cannot get the free space in %s: %s", tempDir, err)
+		} else if free < p.TempSpace {
+			p.warn("insufficient disk space in %s: %d bytes required, %d bytes available", tempDir, p.TempSpace, free)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress modes.
+const (
+	ProgressAuto   = "auto"   // The bar if stdout is a terminal and the output is text, otherwise the events
+	ProgressBar    = "bar"    // A progress bar redrawn on stdout
+	ProgressEvents = "events" // Periodic "progress" records of the logger at the info level
+	ProgressOff    = "off"
+)
+
+var ErrUnknownProgressMode = errors.New("unknown progress mode (auto, bar, events or off)")
+
+// Intervals between the updates of the progress bar and the progress events.
+const (
+	progressBarInterval    = 200 * time.Millisecond
+	progressEventsInterval = 5 * time.Second
+	progressBarWidth       = 30
+)
+
+// swapProgress counts the bytes of the swaps of a run. It is fed by the readers and the writers of the swaps,
+// the methods are safe for concurrent use and do nothing if the progress is nil.
+type swapProgress struct {
+	start time.Time
+	// Unix time in nanoseconds when the swaps were finished, 0 if they are in progress
+	end     atomic.Int64
+	total   atomic.Int64
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func newSwapProgress() *swapProgress {
+	return &swapProgress{start: time.Now()}
+}
+
+// addTotal adds the number of bytes that a swap is going to write.
+func (p *swapProgress) addTotal(n int64) {
+	if p != nil {
+		p.total.Add(n)
+	}
+}
+
+func (p *swapProgress) addRead(n int64) {
+	if p != nil {
+		p.read.Add(n)
+	}
+}
+
+func (p *swapProgress) addWritten(n int64) {
+	if p != nil {
+		p.written.Add(n)
+	}
+}
+
+// finish stops the clock of the progress, so the rate doesn't change anymore.
+func (p *swapProgress) finish() {
+	if p != nil {
+		p.end.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// ProgressSnapshot is the state of the progress at a moment. Done is the number of written bytes.
+type ProgressSnapshot struct {
+	Done  int64 `json:"bytes_done"`
+	Total int64 `json:"bytes_total"`
+	Read  int64 `json:"bytes_read"`
+	// Bytes written per second since the start and the estimated seconds remaining, -1 if unknown
+	Rate    float64 `json:"rate"`
+	ETA     float64 `json:"eta"`
+	Elapsed float64 `json:"elapsed"`
+}
+
+func (p *swapProgress) snapshot() ProgressSnapshot {
+	elapsed := time.Since(p.start)
+	if end := p.end.Load(); end != 0 {
+		elapsed = time.Unix(0, end).Sub(p.start)
+	}
+
+	s := ProgressSnapshot{
+		Done:    p.written.Load(),
+		Total:   p.total.Load(),
+		Read:    p.read.Load(),
+		Elapsed: elapsed.Seconds(),
+		ETA:     -1,
+	}
+	if s.Elapsed > 0 {
+		s.Rate = float64(s.Done) / s.Elapsed
+	}
+	if s.Rate > 0 && s.Total >= s.Done {
+		s.ETA = float64(s.Total-s.Done) / s.Rate
+	}
+	return s
+}
+
+// Percent returns the percentage of the written bytes.
+func (s ProgressSnapshot) Percent() float64 {
+	if s.Total <= 0 {
+		return 0
+	}
+	return 100 * float64(s.Done) / float64(s.Total)
+}
+
+type progressKey struct{}
+
+// contextWithProgress returns the context that carries the progress fed by the swaps.
+func contextWithProgress(ctx context.Context, progress *swapProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// progressFromContext returns the progress of the context or nil.
+func progressFromContext(ctx context.Context) *swapProgress {
+	progress, _ := ctx.Value(progressKey{}).(*swapProgress)
+	return progress
+}
+
+// resolveProgressMode returns the mode used by ProgressAuto: the bar if the output is text
+// and stdout is a terminal, otherwise the events.
+func resolveProgressMode(mode, output string, stdout *os.File) string {
+	if mode != ProgressAuto {
+		return mode
+	}
+	if output == OutputText && isTerminal(stdout) {
+		return ProgressBar
+	}
+	return ProgressEvents
+}
+
+func isTerminal(f *os.File) bool {
+	fileStats, err := f.Stat()
+	return err == nil && fileStats.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgressReporter periodically renders the progress as a bar to out or logs it as events
+// until the returned function is called. The last state is rendered when it's stopped, stop may be called repeatedly.
+func startProgressReporter(progress *swapProgress, mode string, out io.Writer, logger *slog.Logger) (stop func()) {
+	var render func(s ProgressSnapshot, final bool)
+	interval := progressEventsInterval
+
+	switch mode {
+	case ProgressBar:
+		interval = progressBarInterval
+		render = func(s ProgressSnapshot, final bool) {
+			fmt.Fprint(out, "\r"+formatProgressBar(s))
+			if final {
+				fmt.Fprintln(out)
+			}
+		}
+	case ProgressEvents:
+		render = func(s ProgressSnapshot, _ bool) {
+			logger.Info("progress", "bytes_done", s.Done, "bytes_total", s.Total, "bytes_read", s.Read,
+				"percent", s.Percent(), "rate", s.Rate, "eta", s.ETA)
+		}
+	default:
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				// Nothing is rendered if there was nothing to copy
+				if s := progress.snapshot(); s.Total > 0 {
+					render(s, true)
+				}
+				return
+			case <-ticker.C:
+				if s := progress.snapshot(); s.Total > 0 {
+					render(s, false)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// formatProgressBar returns the line of the progress bar, e.g.
+// [###############---------------]  50.0%  8.0 MiB / 16.0 MiB  1.2 MiB/s  ETA 7s
+func formatProgressBar(s ProgressSnapshot) string {
+	filled := int(s.Percent() / 100 * progressBarWidth)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+
+	eta := "?"
+	if s.ETA >= 0 {
+		eta = time.Duration(s.ETA * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("[%s] %5.1f%%  %s / %s  %s/s  ETA %s ",
+		bar, s.Percent(), formatBytes(float64(s.Done)), formatBytes(float64(s.Total)), formatBytes(s.Rate), eta)
+}
+
+// formatBytes returns the size with a binary unit, e.g. 1.5 KiB.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
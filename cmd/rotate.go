@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"TestTask/pkg/file_system"
+)
+
+// RotateFiles cyclically shifts the contents of the files: every file takes the content of the next one,
+// the last file takes the content of the first one.
+// Names must be sorted, so every file takes the content of the file with the next-higher number.
+// The rotation is journaled like SwapTwoFilesJournaled, a canceled rotation is rolled back.
+// Every file is verified against the SHA-256 of the content it receives, computed when the backups are written.
+// The files are locked for the time of the rotation, ErrSameFile is returned for hard links to the same file.
+func RotateFiles(ctx context.Context, fsys file_system.FS, path string, names []string) error {
+	if len(names) < 2 {
+		return ErrNotEnoughFiles
+	}
+
+	fullNames := make([]string, len(names))
+	sources := make([]int, len(names))
+	for i, name := range names {
+		fullNames[i] = path + name
+		sources[i] = (i + 1) % len(names)
+	}
+
+	unlock, err := lockFiles(fsys, fullNames...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	j, err := beginJournal(ctx, fsys, filepath.Dir(fullNames[0]), fullNames, sources)
+	if err != nil {
+		return err
+	}
+
+	if err = j.rollForward(ctx); err != nil {
+		if rbErr := j.rollBack(); rbErr != nil {
+			// The journal stays in the rollback state, so the rollback will be finished on the next start
+			return fmt.Errorf("%w (rollback failed: %s)", err, rbErr)
+		}
+		return err
+	}
+
+	return j.discard()
+}
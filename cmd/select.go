@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"TestTask/pkg/file_system"
+	"TestTask/pkg/num_name"
+)
+
+var (
+	ErrNoFiles        = errors.New("there are no files that fit the conditions")
+	ErrNotEnoughFiles = errors.New("there are not enough files (at least 2) that match the conditions")
+	ErrInvalidPattern = errors.New("invalid file name pattern")
+)
+
+// defaultExtensions are used if neither a pattern nor extensions are set.
+var defaultExtensions = []string{".log"}
+
+// SelectOptions are the conditions for the names of the files.
+type SelectOptions struct {
+	AllowNegativeNames bool // Names with negative numbers, e.g. -5.log
+	AllowDecimalNames  bool // Names with decimal fractions and exponents, e.g. 3.14.log or 1e6.log
+
+	// Pattern of the file name with the named group "num", e.g. app-(?P<num>-?\d+)\.txt.
+	// If the extensions are set, the pattern is matched against the name without the extension.
+	// If it is empty, the whole name without the extension must be a number.
+	Pattern string
+	// Extensions of the files, e.g. .log. If the pattern is set, the extensions are optional.
+	Extensions      []string
+	CaseInsensitive bool
+
+	// Recursive enables scanning of subdirectories, the names of the files are relative to the scanned path.
+	Recursive bool
+	// Include and Exclude are glob patterns. A pattern with a slash is matched against the relative path,
+	// otherwise against the base name. If Include is set, a file must match one of its patterns.
+	// Excluded directories are not scanned.
+	Include []string
+	Exclude []string
+	// FollowSymlinks enables scanning of symlinked directories. Symlinks to files are always selected,
+	// the contents of their targets are swapped.
+	FollowSymlinks bool
+
+	// Progress is called after every batch of directory entries with the total number of scanned entries.
+	Progress func(scanned int)
+}
+
+// Recursive modes.
+const (
+	RecursiveOff    = "off"
+	RecursiveDir    = "dir"    // An independent swap in every directory
+	RecursiveGlobal = "global" // A single swap across the tree
+)
+
+var ErrUnknownRecursiveMode = errors.New("unknown recursive mode (off, dir or global)")
+
+// numberedFile is a file name with the number parsed from it.
+type numberedFile struct {
+	name string
+	num  num_name.Number
+}
+
+// compareNumberedFiles compares files by their numbers.
+// Names with equal numbers (5.log and 005.log) are compared as strings, so the order is stable.
+func compareNumberedFiles(a, b numberedFile) int {
+	if c := num_name.Compare(a.num, b.num); c != 0 {
+		return c
+	}
+	return strings.Compare(a.name, b.name)
+}
+
+// GetFileNamesWithMinMaxNameNum returns the names of the files with the min and max numbers.
+// The directories are read in batches and only the current min and max are kept,
+// so the memory usage doesn't depend on the number of files.
+func GetFileNamesWithMinMaxNameNum(ctx context.Context, fsys file_system.FS, logger *slog.Logger, filesPath string, opts SelectOptions) (string, string, error) {
+	var count int
+	var minFile, maxFile numberedFile
+
+	err := scanNumberedFiles(ctx, fsys, logger, filesPath, opts, func(file numberedFile) {
+		if count == 0 || compareNumberedFiles(file, minFile) < 0 {
+			minFile = file
+		}
+		if count == 0 || compareNumberedFiles(file, maxFile) > 0 {
+			maxFile = file
+		}
+		count++
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	logger.Debug("min and max files found", "files", count, "min", minFile.name, "max", maxFile.name)
+	if count == 0 {
+		return "", "", errNoFiles(opts)
+	} else if count == 1 {
+		return "", "", ErrNotEnoughFiles
+	}
+
+	return minFile.name, maxFile.name, nil
+}
+
+// GetSortedFileNames returns the names of the files that fit the conditions sorted by their numbers.
+func GetSortedFileNames(ctx context.Context, fsys file_system.FS, logger *slog.Logger, filesPath string, opts SelectOptions) ([]string, error) {
+	files, err := readNumberedFiles(ctx, fsys, logger, filesPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, errNoFiles(opts)
+	} else if len(files) == 1 {
+		return nil, ErrNotEnoughFiles
+	}
+
+	return sortedFileNames(files), nil
+}
+
+// sortedFileNames sorts the files by their numbers and returns their names.
+func sortedFileNames(files []numberedFile) []string {
+	sort.Slice(files, func(i, k int) bool {
+		return compareNumberedFiles(files[i], files[k]) < 0
+	})
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.name
+	}
+	return names
+}
+
+// GetFileNamesPerDirectory returns the names of the files sorted by their numbers for every directory
+// that contains at least 2 files that fit the conditions. The directories are sorted by their paths.
+func GetFileNamesPerDirectory(ctx context.Context, fsys file_system.FS, logger *slog.Logger, filesPath string, opts SelectOptions) ([][]string, error) {
+	files, err := readNumberedFiles(ctx, fsys, logger, filesPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errNoFiles(opts)
+	}
+
+	sort.Slice(files, func(i, k int) bool {
+		iDir, kDir := filepath.Dir(files[i].name), filepath.Dir(files[k].name)
+		if iDir != kDir {
+			return iDir < kDir
+		}
+		return compareNumberedFiles(files[i], files[k]) < 0
+	})
+
+	var groups [][]string
+	for i := 0; i < len(files); {
+		dir := filepath.Dir(files[i].name)
+
+		var names []string
+		for ; i < len(files) && filepath.Dir(files[i].name) == dir; i++ {
+			names = append(names, files[i].name)
+		}
+
+		if len(names) > 1 {
+			groups = append(groups, names)
+		}
+	}
+
+	if len(groups) == 0 {
+		return nil, ErrNotEnoughFiles
+	}
+	return groups, nil
+}
+
+// errNoFiles returns ErrNoFiles with the conditions of the names.
+func errNoFiles(opts SelectOptions) error {
+	matcher, err := newNameMatcher(opts)
+	if err != nil {
+		return ErrNoFiles
+	}
+	return fmt.Errorf("%w (%s)", ErrNoFiles, matcher)
+}
+
+// readNumberedFiles returns the files that fit the conditions.
+func readNumberedFiles(ctx context.Context, fsys file_system.FS, logger *slog.Logger, filesPath string, opts SelectOptions) ([]numberedFile, error) {
+	var files []numberedFile
+	err := scanNumberedFiles(ctx, fsys, logger, filesPath, opts, func(file numberedFile) {
+		files = append(files, file)
+	})
+	return files, err
+}
+
+// scanNumberedFiles calls fn for every file that fits the conditions.
+func scanNumberedFiles(ctx context.Context, fsys file_system.FS, logger *slog.Logger, filesPath string, opts SelectOptions, fn func(file numberedFile)) error {
+	matcher, err := newNameMatcher(opts)
+	if err != nil {
+		return err
+	}
+
+	return walkDirs(ctx, fsys, logger, filesPath, opts, nil, func(dir string, entry os.DirEntry) error {
+		name := filepath.Join(dir, entry.Name())
+		if !includeFile(opts, name) {
+			return nil
+		}
+
+		if num, ok := matcher.Match(entry.Name()); ok {
+			logger.Debug("file matched", "name", name)
+			fn(numberedFile{name: name, num: num})
+		}
+		return nil
+	})
+}
+
+// walkDirs scans the root directory and, in the recursive mode, every subdirectory.
+// dirFn is called for every directory before its files, fileFn is called for every file.
+// Both receive paths relative to the root, any of them may be nil.
+// The directories are read from the filesystem. The scan is stopped if the context is canceled.
+func walkDirs(ctx context.Context, fsys file_system.FS, logger *slog.Logger, root string, opts SelectOptions, dirFn func(dir string) error, fileFn func(dir string, entry os.DirEntry) error) error {
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrInvalidPattern, pattern, err)
+		}
+	}
+
+	w := &dirWalker{
+		ctx:     ctx,
+		fs:      fsys,
+		logger:  logger,
+		root:    root,
+		opts:    opts,
+		dirFn:   dirFn,
+		fileFn:  fileFn,
+		visited: map[string]bool{},
+	}
+	return w.walk("")
+}
+
+// readDirBatchSize is the number of directory entries read at a time.
+const readDirBatchSize = 1024
+
+type dirWalker struct {
+	ctx     context.Context
+	fs      file_system.FS
+	logger  *slog.Logger
+	root    string
+	opts    SelectOptions
+	dirFn   func(dir string) error
+	fileFn  func(dir string, entry os.DirEntry) error
+	visited map[string]bool // Real paths of the scanned directories, used to detect symlink loops
+	scanned int
+}
+
+func (w *dirWalker) walk(dir string) error {
+	fullDir := filepath.Join(w.root, dir)
+
+	if w.opts.FollowSymlinks {
+		realDir, err := w.fs.EvalSymlinks(fullDir)
+		if err != nil {
+			return err
+		}
+		if w.visited[realDir] {
+			return nil
+		}
+		w.visited[realDir] = true
+	}
+
+	w.logger.Debug("scanning directory", "dir", fullDir)
+
+	if w.dirFn != nil {
+		if err := w.dirFn(dir); err != nil {
+			return err
+		}
+	}
+
+	subdirs, err := w.scanDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, subdir := range subdirs {
+		if err = w.walk(subdir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanDir reads the directory in batches without sorting and without stat calls
+// (except for symlinks) and returns its subdirectories to be scanned.
+func (w *dirWalker) scanDir(dir string) ([]string, error) {
+	fullDir := filepath.Join(w.root, dir)
+
+	f, err := file_system.Open(w.fs, fullDir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var subdirs []string
+	for {
+		if err = w.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		entries, err := f.ReadDir(readDirBatchSize)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			isDir := entry.IsDir()
+			if entry.Type()&os.ModeSymlink != 0 {
+				fileStats, err := w.fs.Stat(filepath.Join(fullDir, entry.Name()))
+				if err != nil {
+					// Broken symlink
+					continue
+				}
+				isDir = fileStats.IsDir()
+				if isDir && !w.opts.FollowSymlinks {
+					continue
+				}
+			}
+
+			if isDir {
+				name := filepath.Join(dir, entry.Name())
+				if w.opts.Recursive && !matchGlobs(w.opts.Exclude, name) {
+					subdirs = append(subdirs, name)
+				}
+				continue
+			}
+
+			if w.fileFn != nil {
+				if err = w.fileFn(dir, entry); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		w.scanned += len(entries)
+		if w.opts.Progress != nil {
+			w.opts.Progress(w.scanned)
+		}
+	}
+
+	// The order of the entries is not defined, subdirectories are sorted to make the scan reproducible
+	sort.Strings(subdirs)
+	return subdirs, nil
+}
+
+// includeFile checks the relative path of the file with the include and exclude patterns.
+func includeFile(opts SelectOptions, name string) bool {
+	if matchGlobs(opts.Exclude, name) {
+		return false
+	}
+	return len(opts.Include) == 0 || matchGlobs(opts.Include, name)
+}
+
+func matchGlobs(patterns []string, name string) bool {
+	name = filepath.ToSlash(name)
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nameMatcher checks file names and parses numbers from them.
+type nameMatcher struct {
+	opts       SelectOptions
+	pattern    *regexp.Regexp
+	numIndex   int
+	extensions []string
+}
+
+func newNameMatcher(opts SelectOptions) (*nameMatcher, error) {
+	m := &nameMatcher{
+		opts:       opts,
+		extensions: opts.Extensions,
+	}
+
+	if opts.Pattern == "" {
+		if len(m.extensions) == 0 {
+			m.extensions = defaultExtensions
+		}
+		return m, nil
+	}
+
+	pattern := "^(?:" + opts.Pattern + ")$"
+	if opts.CaseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+
+	var err error
+	if m.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPattern, err)
+	}
+	if m.numIndex = m.pattern.SubexpIndex("num"); m.numIndex < 0 {
+		return nil, fmt.Errorf("%w: there is no group (?P<num>...) in %s", ErrInvalidPattern, opts.Pattern)
+	}
+
+	return m, nil
+}
+
+// Match returns the number of the file name if the name fits the conditions.
+func (m *nameMatcher) Match(name string) (num_name.Number, bool) {
+	numStr := name
+
+	if len(m.extensions) > 0 {
+		stem, ok := m.cutExtension(name)
+		if !ok {
+			return num_name.Number{}, false
+		}
+		numStr = stem
+	}
+
+	if m.pattern != nil {
+		match := m.pattern.FindStringSubmatch(numStr)
+		if match == nil {
+			return num_name.Number{}, false
+		}
+		numStr = match[m.numIndex]
+	}
+
+	if !m.opts.AllowNegativeNames && strings.HasPrefix(numStr, "-") {
+		return num_name.Number{}, false
+	}
+
+	parse := num_name.Parse
+	if m.opts.AllowDecimalNames {
+		parse = num_name.ParseDecimal
+	}
+
+	num, err := parse(numStr)
+	if err != nil {
+		return num_name.Number{}, false
+	}
+	return num, true
+}
+
+// String describes the conditions, e.g. "[-][0-9]*.log or [-][0-9]*.txt, case-insensitive".
+func (m *nameMatcher) String() string {
+	var conditions []string
+	if m.pattern == nil {
+		num := "[0-9]*"
+		if m.opts.AllowNegativeNames {
+			num = "[-]" + num
+		}
+
+		names := make([]string, len(m.extensions))
+		for i, ext := range m.extensions {
+			names[i] = num + ext
+		}
+		conditions = append(conditions, strings.Join(names, " or "))
+	} else if len(m.extensions) > 0 {
+		conditions = append(conditions, m.opts.Pattern+" with "+strings.Join(m.extensions, " or "))
+	} else {
+		conditions = append(conditions, m.opts.Pattern)
+	}
+
+	if m.opts.AllowDecimalNames {
+		conditions = append(conditions, "decimal numbers")
+	}
+	if m.pattern != nil && !m.opts.AllowNegativeNames {
+		conditions = append(conditions, "non-negative numbers")
+	}
+	if m.opts.CaseInsensitive {
+		conditions = append(conditions, "case-insensitive")
+	}
+	return strings.Join(conditions, ", ")
+}
+
+// cutExtension returns the name without one of the extensions.
+func (m *nameMatcher) cutExtension(name string) (string, bool) {
+	for _, ext := range m.extensions {
+		if len(name) <= len(ext) {
+			continue
+		}
+
+		nameExt := name[len(name)-len(ext):]
+		if nameExt == ext || (m.opts.CaseInsensitive && strings.EqualFold(nameExt, ext)) {
+			return name[:len(name)-len(ext)], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"TestTask/internal/config"
+	"TestTask/pkg/file_system"
+)
+
+// CommandServe is the name of the serve mode: the binary runs an HTTP API until it's signaled.
+const CommandServe = "serve"
+
+// States of the swap started by the API.
+const (
+	SwapStateIdle     = "idle"
+	SwapStateRunning  = "running"
+	SwapStateFinished = "finished"
+)
+
+var (
+	ErrSwapRunning      = errors.New("a swap is already running")
+	ErrNoResult         = errors.New("there is no finished swap")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+)
+
+// serveShutdownTimeout is the time given to the requests in progress when the server is stopped.
+const serveShutdownTimeout = 5 * time.Second
+
+// SwapStatus is the state of the last swap started by the API.
+type SwapStatus struct {
+	State      string     `json:"state"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Seconds since the start, until the end if the swap is finished
+	Elapsed float64 `json:"elapsed"`
+	// Bytes written by the swap, the rate and the estimated time remaining
+	Progress *ProgressSnapshot `json:"progress,omitempty"`
+}
+
+// FileList is the list of the files that fit the conditions sorted by their numbers.
+type FileList struct {
+	Files []ResultFile `json:"files"`
+}
+
+// server is the HTTP API. The files are selected and swapped by the same functions as in the CLI:
+// a swap started by the API is run, so it takes the directory lock and recovers interrupted swaps.
+type server struct {
+	// ctx cancels the swaps when the server is stopped
+	ctx      context.Context
+	fs       file_system.FS
+	logger   *slog.Logger
+	opts     runOptions
+	cfg      *config.Config
+	strategy SwapStrategy
+	metrics  *runMetrics
+
+	mu       sync.Mutex
+	status   SwapStatus
+	progress *swapProgress
+	last     *RunResult
+	wg       sync.WaitGroup
+}
+
+// newServer validates the options and reads the config.
+func newServer(ctx context.Context, fsys file_system.FS, logger *slog.Logger, opts runOptions) (*server, *ResultError) {
+	cfg, err := config.NewConfig(opts.configPath)
+	if err != nil {
+		return nil, newResultError(ErrorCodeConfig, fmt.Errorf("cannot read config file: %w", err))
+	}
+
+	strategy, err := NewSwapStrategy(opts.strategyName, opts.readBlockSize, opts.writeBlockSize, opts.journal)
+	if err != nil {
+		return nil, newResultError(ErrorCodeConfig, fmt.Errorf("NewSwapStrategy: %w", err))
+	}
+
+	if opts.recursiveMode != RecursiveOff && opts.recursiveMode != RecursiveDir && opts.recursiveMode != RecursiveGlobal {
+		return nil, newResultError(ErrorCodeConfig, fmt.Errorf("%w: %s", ErrUnknownRecursiveMode, opts.recursiveMode))
+	}
+	if _, err = newNameMatcher(newSelectOptions(opts, cfg, logger)); err != nil {
+		return nil, newResultError(errorCode(err), err)
+	}
+
+	// The results of the swaps contain the checksums, the progress is polled or logged
+	opts.output = OutputJSON
+	if opts.progress == ProgressAuto || opts.progress == ProgressBar {
+		opts.progress = ProgressEvents
+	}
+
+	return &server{
+		ctx:      ctx,
+		fs:       fsys,
+		logger:   logger,
+		opts:     opts,
+		cfg:      cfg,
+		strategy: strategy,
+		metrics:  newRunMetrics(),
+		status:   SwapStatus{State: SwapStateIdle},
+	}, nil
+}
+
+// handler returns the routes of the API:
+//
+//	GET  /files  - the files that fit the conditions sorted by their numbers
+//	GET  /pair   - the plan of the swap of the files with the min and max numbers
+//	POST /swap   - start a swap (or a rotation with -rotate) in the background
+//	GET  /swap   - the state of the last started swap
+//	GET  /result - the result of the last finished swap
+//	GET  /metrics - the Prometheus metrics of the swaps
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files", s.handleFiles)
+	mux.HandleFunc("/pair", s.handlePair)
+	mux.HandleFunc("/swap", s.handleSwap)
+	mux.HandleFunc("/result", s.handleResult)
+	mux.Handle("/metrics", s.metrics.handler())
+	return mux
+}
+
+func (s *server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, newResultError(ErrorCodeConfig, ErrMethodNotAllowed))
+		return
+	}
+
+	// Unlike GetSortedFileNames, a single file or no files are not an error
+	files, err := readNumberedFiles(r.Context(), s.fs, s.logger, s.cfg.PathToFiles, newSelectOptions(s.opts, s.cfg, s.logger))
+	if err != nil {
+		writeError(w, errorStatus(err), newResultError(errorCode(err), err))
+		return
+	}
+
+	group, err := newResultGroup(s.fs, s.cfg.PathToFiles, sortedFileNames(files))
+	if err != nil {
+		writeError(w, errorStatus(err), newResultError(errorCode(err), err))
+		return
+	}
+	writeJSON(w, http.StatusOK, FileList{Files: group.Files})
+}
+
+func (s *server) handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, newResultError(ErrorCodeConfig, ErrMethodNotAllowed))
+		return
+	}
+
+	minName, maxName, err := GetFileNamesWithMinMaxNameNum(r.Context(), s.fs, s.logger, s.cfg.PathToFiles, newSelectOptions(s.opts, s.cfg, s.logger))
+	if err != nil {
+		writeError(w, errorStatus(err), newResultError(errorCode(err), err))
+		return
+	}
+
+	plan, err := PlanSwap(s.fs, s.strategy, s.cfg.PathToFiles, minName, maxName)
+	if err != nil {
+		writeError(w, errorStatus(err), newResultError(errorCode(err), err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newPlannedGroup(plan))
+}
+
+func (s *server) handleSwap(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.swapStatus())
+	case http.MethodPost:
+		status, err := s.startSwap()
+		if err != nil {
+			writeError(w, http.StatusConflict, newResultError(ErrorCodeBusy, err))
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, newResultError(ErrorCodeConfig, ErrMethodNotAllowed))
+	}
+}
+
+func (s *server) handleResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, newResultError(ErrorCodeConfig, ErrMethodNotAllowed))
+		return
+	}
+
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+
+	if last == nil {
+		writeError(w, http.StatusNotFound, newResultError(ErrorCodeNoResult, ErrNoResult))
+		return
+	}
+	writeJSON(w, http.StatusOK, last)
+}
+
+// startSwap runs the swap in the background. Only one swap runs at a time.
+func (s *server) startSwap() (SwapStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status.State == SwapStateRunning {
+		return s.status, ErrSwapRunning
+	}
+
+	start := time.Now()
+	s.status = SwapStatus{State: SwapStateRunning, StartedAt: &start}
+	progress := newSwapProgress()
+	s.progress = progress
+	s.logger.Info("swap started by the API")
+
+	ctx := contextWithProgress(s.ctx, progress)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		result := runWithTimeout(ctx, s.fs, s.logger, s.opts, io.Discard, s.metrics)
+		progress.finish()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		finish := time.Now()
+		s.status.State = SwapStateFinished
+		s.status.FinishedAt = &finish
+		s.last = result
+	}()
+
+	return s.status, nil
+}
+
+func (s *server) swapStatus() SwapStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.status
+	switch {
+	case status.FinishedAt != nil:
+		status.Elapsed = status.FinishedAt.Sub(*status.StartedAt).Seconds()
+	case status.StartedAt != nil:
+		status.Elapsed = time.Since(*status.StartedAt).Seconds()
+	}
+	if s.progress != nil {
+		progress := s.progress.snapshot()
+		status.Progress = &progress
+	}
+	return status
+}
+
+// wait waits until the swap in progress is finished.
+func (s *server) wait() {
+	s.wg.Wait()
+}
+
+// serve runs the HTTP API on the address until the context is canceled.
+// The swap in progress is canceled and rolled back when the server is stopped.
+func serve(ctx context.Context, fsys file_system.FS, logger *slog.Logger, opts runOptions, out io.Writer) *ResultError {
+	s, resultErr := newServer(ctx, fsys, logger, opts)
+	if resultErr != nil {
+		return resultErr
+	}
+
+	httpServer := &http.Server{
+		Addr:              opts.listen,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	fmt.Fprintf(out, "Serving the API on %s.\n", opts.listen)
+	logger.Info("serving the API", "addr", opts.listen)
+
+	select {
+	case err := <-serveErr:
+		return newResultError(ErrorCodeIO, fmt.Errorf("cannot serve the API: %w", err))
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	s.wait()
+	if err != nil {
+		return newResultError(ErrorCodeIO, fmt.Errorf("cannot stop the API: %w", err))
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status of the error of the file selection or processing.
+func errorStatus(err error) int {
+	switch errorCode(err) {
+	case ErrorCodeNoFiles, ErrorCodeNotEnoughFiles:
+		return http.StatusNotFound
+	case ErrorCodeLocked:
+		return http.StatusConflict
+	case ErrorCodeCanceled, ErrorCodeTimeout:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, resultErr *ResultError) {
+	writeJSON(w, status, struct {
+		Error *ResultError `json:"error"`
+	}{resultErr})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"TestTask/pkg/file_system"
+)
+
+const snapshotBlockSize = 64 * 1024
+
+// fileSnapshot keeps the original content of the region of a file that is about to be overwritten.
+// Writers overwrite files sequentially from the beginning, so the region is always a prefix of the file
+// and the saved data is stored in a temporary undo file at the same offsets.
+type fileSnapshot struct {
+	file  snapshotFile
+	size  int64 // Original size of the file
+	saved int64 // Length of the saved prefix
+	fs    file_system.FS
+	undo  file_system.File
+}
+
+// snapshotFile is a file that can be restored by fileSnapshot.
+type snapshotFile interface {
+	syncWriterAt
+	io.ReaderAt
+	Size() int64
+	Truncate(size int64) error
+}
+
+// newFileSnapshot creates the undo file in the temporary directory of the filesystem.
+func newFileSnapshot(fsys file_system.FS, file snapshotFile) (*fileSnapshot, error) {
+	undo, err := fsys.CreateTemp("", ".swap-undo-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSnapshot{
+		fs:   fsys,
+		file: file,
+		size: file.Size(),
+		undo: undo,
+	}, nil
+}
+
+// Save must be called before writing n bytes at the offset.
+// The data is saved ahead in blocks of at least snapshotBlockSize bytes to reduce the number of file accesses.
+func (s *fileSnapshot) Save(offset int64, n int) error {
+	end := offset + int64(n)
+	if end <= s.saved {
+		return nil
+	}
+	if end < s.saved+snapshotBlockSize {
+		end = s.saved + snapshotBlockSize
+	}
+	if end > s.size {
+		end = s.size
+	}
+	if end <= s.saved {
+		return nil
+	}
+
+	buf := make([]byte, end-s.saved)
+	if _, err := s.file.ReadAt(buf, s.saved); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if _, err := s.undo.WriteAt(buf, s.saved); err != nil {
+		return err
+	}
+
+	s.saved = end
+	return nil
+}
+
+// Restore writes the saved prefix back and truncates the file to its original size.
+// It is called after a failure or a cancellation, so it is not canceled itself.
+func (s *fileSnapshot) Restore() error {
+	if err := copyRegion(context.Background(), s.file, s.undo, 0, s.saved, nil); err != nil {
+		return err
+	}
+	return s.file.Truncate(s.size)
+}
+
+// Close removes the undo file.
+func (s *fileSnapshot) Close() error {
+	err := s.undo.Close()
+	if rmErr := s.fs.Remove(s.undo.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
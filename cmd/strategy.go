@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"TestTask/pkg/file_system"
+)
+
+// Swap strategies.
+const (
+	StrategyAuto     = "auto"
+	StrategyExchange = "exchange"
+	StrategyRename   = "rename"
+	StrategyStream   = "stream"
+	StrategyZeroCopy = "zerocopy"
+)
+
+var (
+	ErrUnknownStrategy      = errors.New("unknown swap strategy (auto, exchange, rename, stream or zerocopy)")
+	ErrExchangeNotSupported = errors.New("atomic exchange of files is not supported")
+	ErrSymlinkNotSupported  = errors.New("the strategy swaps directory entries and can't swap the targets of symlinks")
+)
+
+// SwapStrategy swaps the contents of two files located in the path directory.
+type SwapStrategy interface {
+	Name() string
+	// A canceled swap is rolled back or, for the journaled strategies, finished on the next start.
+	Swap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) error
+	// Estimate fills the strategy, the I/O and the disk space of the plan and adds the warnings.
+	Estimate(plan *SwapPlan)
+}
+
+// NewSwapStrategy returns a strategy by its name.
+// Block sizes and journaling are used by the stream strategy.
+func NewSwapStrategy(name string, readBlockSize, writeBlockSize int, journal bool) (SwapStrategy, error) {
+	stream := &streamStrategy{
+		readBlockSize:  readBlockSize,
+		writeBlockSize: writeBlockSize,
+		journal:        journal,
+	}
+
+	switch name {
+	case StrategyAuto:
+		return &autoStrategy{stream: stream, zeroCopy: &zeroCopyStrategy{}}, nil
+	case StrategyExchange:
+		return exchangeStrategy{}, nil
+	case StrategyRename:
+		return renameStrategy{}, nil
+	case StrategyStream:
+		return stream, nil
+	case StrategyZeroCopy:
+		return &zeroCopyStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, name)
+	}
+}
+
+// exchangeStrategy atomically exchanges the directory entries of the files.
+type exchangeStrategy struct{}
+
+func (exchangeStrategy) Name() string {
+	return StrategyExchange
+}
+
+func (exchangeStrategy) Estimate(plan *SwapPlan) {
+	plan.Strategy = StrategyExchange
+	estimateRenames(plan)
+}
+
+func (exchangeStrategy) Swap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := checkNoSymlinks(fsys, path+firstName, path+secondName); err != nil {
+		return err
+	}
+	// renameat2 exchanges the files of the OS filesystem only
+	if !file_system.IsOS(fsys) {
+		return ErrExchangeNotSupported
+	}
+
+	// The files aren't exchanged while another process is copying them
+	unlock, err := lockFiles(fsys, path+firstName, path+secondName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = exchangeFiles(path+firstName, path+secondName); err != nil {
+		return err
+	}
+	syncDir(fsys, filepath.Dir(path+firstName))
+	return nil
+}
+
+// renameStrategy swaps the directory entries of the files with a sequence of renames through a temporary name.
+// The sequence is journaled, so an interrupted swap is finished by RecoverSwap.
+type renameStrategy struct{}
+
+func (renameStrategy) Name() string {
+	return StrategyRename
+}
+
+func (renameStrategy) Estimate(plan *SwapPlan) {
+	plan.Strategy = StrategyRename
+	estimateRenames(plan)
+}
+
+// estimateRenames estimates the strategies that swap directory entries: nothing is copied.
+func estimateRenames(plan *SwapPlan) {
+	plan.checkDirAccess()
+	if !plan.sameDevs {
+		plan.warn("the files are located on different filesystems, use the stream or zerocopy strategy")
+	}
+	if plan.symlinks {
+		plan.warn("the files are symlinks, their targets can't be swapped by the strategy, use the stream or zerocopy strategy")
+	}
+}
+
+// checkNoSymlinks returns ErrSymlinkNotSupported if any of the files is a symlink. Swapping the directory entries
+// would swap the symlinks, while the copying strategies swap the contents of their targets.
+func checkNoSymlinks(fsys file_system.FS, names ...string) error {
+	for _, name := range names {
+		fileStats, err := fsys.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if fileStats.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s", ErrSymlinkNotSupported, name)
+		}
+	}
+	return nil
+}
+
+// checkSameDirDevice returns the EXDEV error if the directories of the files are on different filesystems.
+func checkSameDirDevice(fsys file_system.FS, firstName, secondName string) error {
+	firstDir, err := fsys.Stat(filepath.Dir(firstName))
+	if err != nil {
+		return err
+	}
+	secondDir, err := fsys.Stat(filepath.Dir(secondName))
+	if err != nil {
+		return err
+	}
+	if !sameDevice(firstDir, secondDir) {
+		return &os.LinkError{Op: "rename", Old: secondName, New: firstName, Err: syscall.EXDEV}
+	}
+	return nil
+}
+
+func (renameStrategy) Swap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := checkNoSymlinks(fsys, path+firstName, path+secondName); err != nil {
+		return err
+	}
+
+	// Files on different filesystems can't be renamed into each other's place, nothing is moved
+	if err := checkSameDirDevice(fsys, path+firstName, path+secondName); err != nil {
+		return err
+	}
+
+	unlock, err := lockFiles(fsys, path+firstName, path+secondName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	j, err := beginRenameJournal(fsys, filepath.Dir(path+firstName), path+firstName, path+secondName)
+	if err != nil {
+		return err
+	}
+
+	// On error the journal stays, so the swap will be finished on the next start.
+	// EXDEV means that the first rename is undone, so the journal is discarded and the caller may copy the files.
+	if err = j.rollForward(ctx); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			if discardErr := j.discard(); discardErr != nil {
+				return fmt.Errorf("%w (discard failed: %s)", err, discardErr)
+			}
+		}
+		return err
+	}
+	return j.discard()
+}
+
+// streamStrategy copies the contents of the files into each other byte by byte.
+// Unlike the other strategies it works for files located on different filesystems.
+type streamStrategy struct {
+	readBlockSize  int
+	writeBlockSize int
+	journal        bool
+}
+
+func (s *streamStrategy) Name() string {
+	return StrategyStream
+}
+
+func (s *streamStrategy) Estimate(plan *SwapPlan) {
+	plan.Strategy = StrategyStream
+	plan.checkFilesAccess()
+
+	// Every file is read once and overwritten with the content of the other one.
+	// The overwritten part of every file is saved to a temporary undo file.
+	size := plan.totalSize()
+	plan.BytesRead = size
+	plan.BytesWritten = size
+	plan.ExtraSpace = plan.maxGrowth()
+	plan.TempSpace = size - plan.maxGrowth()
+
+	if s.journal {
+		// The backups replace the undo files
+		plan.Strategy += " (journal)"
+		plan.checkDirAccess()
+		plan.BytesRead += size
+		plan.BytesWritten += size
+		plan.ExtraSpace += size
+		plan.TempSpace = 0
+	}
+}
+
+func (s *streamStrategy) Swap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) error {
+	if s.journal {
+		return SwapTwoFilesJournaled(ctx, fsys, logger, path, firstName, secondName, s.readBlockSize, s.writeBlockSize)
+	}
+	return SwapTwoFiles(ctx, fsys, logger, path, firstName, secondName, s.readBlockSize, s.writeBlockSize)
+}
+
+// zeroCopyStrategy copies the contents of the files through a temporary file with copy_file_range,
+// so the data doesn't pass through userspace. If the syscall isn't supported, the data is copied in userspace.
+// Like the stream strategy it works for files located on different filesystems.
+type zeroCopyStrategy struct {
+	used string
+}
+
+func (s *zeroCopyStrategy) Name() string {
+	if s.used != "" {
+		return StrategyZeroCopy + " (" + s.used + ")"
+	}
+	return StrategyZeroCopy
+}
+
+func (s *zeroCopyStrategy) Estimate(plan *SwapPlan) {
+	plan.Strategy = StrategyZeroCopy
+	plan.checkFilesAccess()
+	plan.checkDirAccess()
+
+	// The first file is copied to the temporary file, the second one to the first one
+	// and the temporary file to the second one
+	first := plan.Files[0].Size
+	plan.BytesRead = plan.totalSize() + first
+	plan.BytesWritten = plan.totalSize() + first
+	plan.ExtraSpace = first + plan.maxGrowth()
+	if runtime.GOOS != "linux" {
+		plan.warn("copy_file_range is not supported, the data is copied in userspace")
+	}
+}
+
+func (s *zeroCopyStrategy) Swap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) error {
+	kernel, err := SwapTwoFilesZeroCopy(ctx, fsys, path, firstName, secondName)
+	s.used = "userspace"
+	if kernel {
+		s.used = "copy_file_range"
+	}
+	return err
+}
+
+// autoStrategy uses the atomic exchange if the platform and the filesystem support it,
+// otherwise the sequence of renames. Files on different filesystems and symlinks are copied
+// with the zerocopy strategy or, if the journal is requested, streamed.
+type autoStrategy struct {
+	stream   *streamStrategy
+	zeroCopy *zeroCopyStrategy
+	used     string
+}
+
+// copier returns the strategy for files located on different filesystems and for symlinks.
+func (s *autoStrategy) copier() SwapStrategy {
+	if s.stream.journal {
+		return s.stream
+	}
+	return s.zeroCopy
+}
+
+func (s *autoStrategy) Name() string {
+	if s.used != "" {
+		return StrategyAuto + " (" + s.used + ")"
+	}
+	return StrategyAuto
+}
+
+func (s *autoStrategy) Estimate(plan *SwapPlan) {
+	switch {
+	case !plan.sameDevs || plan.symlinks:
+		s.copier().Estimate(plan)
+	case runtime.GOOS == "linux":
+		exchangeStrategy{}.Estimate(plan)
+		plan.warn("the rename strategy is used if the filesystem doesn't support the atomic exchange")
+	default:
+		renameStrategy{}.Estimate(plan)
+	}
+	plan.Strategy = StrategyAuto + " (" + plan.Strategy + ")"
+}
+
+func (s *autoStrategy) Swap(ctx context.Context, fsys file_system.FS, logger *slog.Logger, path, firstName, secondName string) error {
+	s.used = StrategyExchange
+	err := exchangeStrategy{}.Swap(ctx, fsys, logger, path, firstName, secondName)
+	if errors.Is(err, ErrExchangeNotSupported) {
+		logger.Debug("the atomic exchange is not supported, falling back to renames")
+		s.used = StrategyRename
+		err = renameStrategy{}.Swap(ctx, fsys, logger, path, firstName, secondName)
+	}
+	if errors.Is(err, syscall.EXDEV) || errors.Is(err, ErrSymlinkNotSupported) {
+		copier := s.copier()
+		logger.Debug("the files are on different filesystems or symlinks, falling back to copying", "strategy", copier.Name(), "error", err)
+		err = copier.Swap(ctx, fsys, logger, path, firstName, secondName)
+		s.used = copier.Name()
+	}
+	return err
+}
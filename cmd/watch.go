@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"TestTask/internal/config"
+	"TestTask/pkg/file_system"
+)
+
+// CommandWatch is the name of the watch mode: the binary runs until it's signaled
+// and swaps the files every time the directory changes.
+const CommandWatch = "watch"
+
+// Watch policies decide which changes of the numbered files trigger a swap.
+const (
+	WatchPolicyChange = "change" // Any file is created, modified, renamed or removed
+	WatchPolicyNew    = "new"    // A new file is created or moved into the directory
+	WatchPolicyPair   = "pair"   // The files with the min and max numbers are different from the last swapped ones
+)
+
+var (
+	ErrUnknownWatchPolicy = errors.New("unknown watch policy (change, new or pair)")
+	ErrWatchRecursive     = errors.New("the watch mode doesn't support the recursive scan")
+	ErrInvalidDebounce    = errors.New("invalid debounce interval")
+	ErrWatchNotSupported  = errors.New("watching a directory is not supported on this platform")
+	ErrWatchedDirRemoved  = errors.New("the watched directory was removed or moved")
+)
+
+// dirEvent is a change of a file in the watched directory.
+type dirEvent struct {
+	Name string
+	// Created is set if the file was created or moved into the directory
+	Created bool
+	// Overflow is set if events were lost, so any file may have changed
+	Overflow bool
+}
+
+// watch watches the directory from the config and runs run after the changes of the numbered files
+// according to the policy. Changes are debounced: the run starts when there were no changes for the debounce interval.
+// Every run is reported, its errors don't stop the watch. The timeout, if set, limits every run.
+// If the metrics address is set, the metrics of the runs are served on it.
+// watch returns nil when the context is canceled and an error if the watch can't be started or continued.
+func watch(ctx context.Context, fsys file_system.FS, logger *slog.Logger, opts runOptions, out io.Writer, report func(*RunResult)) *ResultError {
+	if opts.watchPolicy != WatchPolicyChange && opts.watchPolicy != WatchPolicyNew && opts.watchPolicy != WatchPolicyPair {
+		return newResultError(ErrorCodeConfig, fmt.Errorf("%w: %s", ErrUnknownWatchPolicy, opts.watchPolicy))
+	}
+	if opts.debounce <= 0 {
+		return newResultError(ErrorCodeConfig, fmt.Errorf("%w: %s", ErrInvalidDebounce, opts.debounce))
+	}
+	if opts.recursiveMode != RecursiveOff {
+		return newResultError(ErrorCodeConfig, ErrWatchRecursive)
+	}
+
+	cfg, err := config.NewConfig(opts.configPath)
+	if err != nil {
+		return newResultError(ErrorCodeConfig, fmt.Errorf("cannot read config file: %w", err))
+	}
+
+	selectOpts := newSelectOptions(opts, cfg, logger)
+	matcher, err := newNameMatcher(selectOpts)
+	if err != nil {
+		return newResultError(errorCode(err), err)
+	}
+
+	metrics := newRunMetrics()
+	if opts.metricsListen != "" {
+		stopMetrics, err := serveMetrics(opts.metricsListen, metrics)
+		if err != nil {
+			return newResultError(ErrorCodeIO, fmt.Errorf("cannot serve the metrics: %w", err))
+		}
+		defer stopMetrics()
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := make(chan dirEvent, 64)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- watchDir(watchCtx, cfg.PathToFiles, events)
+	}()
+
+	// The pair that is already swapped, the swap is not repeated until a file with a new min or max number appears
+	var lastPair [2]string
+	if opts.watchPolicy == WatchPolicyPair {
+		lastPair[0], lastPair[1], _ = GetFileNamesWithMinMaxNameNum(ctx, fsys, logger, cfg.PathToFiles, selectOpts)
+	}
+
+	// The files modified by the last run and their state after it. The events of a file are ignored while it stays
+	// in that state, so the events of the swap itself are ignored however late they are read,
+	// and a change made after the swap is not
+	touched := map[string]os.FileInfo{}
+
+	debounce := time.NewTimer(opts.debounce)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+
+	fmt.Fprintf(out, "Watching %s (policy: %s).\n", cfg.PathToFiles, opts.watchPolicy)
+	logger.Info("watching the directory", "dir", cfg.PathToFiles, "policy", opts.watchPolicy, "debounce", opts.debounce)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err = <-watchErr:
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.Error("cannot watch the directory", "error", err)
+			return newResultError(errorCode(err), fmt.Errorf("cannot watch the directory: %w", err))
+
+		case event := <-events:
+			logger.Debug("directory event", "name", event.Name, "created", event.Created, "overflow", event.Overflow)
+			if !event.Overflow {
+				if _, ok := matcher.Match(event.Name); !ok {
+					continue
+				}
+				if fileStats, ok := touched[event.Name]; ok {
+					if fileUnchanged(fsys, cfg.PathToFiles+event.Name, fileStats) {
+						continue
+					}
+					delete(touched, event.Name)
+				}
+				if opts.watchPolicy == WatchPolicyNew && !event.Created {
+					continue
+				}
+			}
+
+			// Every change postpones the run
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(opts.debounce)
+
+		case <-debounce.C:
+			if opts.watchPolicy == WatchPolicyPair {
+				minName, maxName, err := GetFileNamesWithMinMaxNameNum(ctx, fsys, logger, cfg.PathToFiles, selectOpts)
+				if err == nil && [2]string{minName, maxName} == lastPair {
+					logger.Debug("the pair is already swapped", "min", minName, "max", maxName)
+					continue
+				}
+			}
+
+			logger.Info("the directory changed, running the swap")
+			result := runWithTimeout(ctx, fsys, logger, opts, out, metrics)
+
+			// The state is recorded before the result is reported, so the changes made after that aren't ignored
+			touched = map[string]os.FileInfo{}
+			for _, group := range result.Groups {
+				for _, file := range group.Files {
+					if fileStats, err := fsys.Stat(cfg.PathToFiles + file.Name); err == nil {
+						touched[file.Name] = fileStats
+					}
+				}
+			}
+
+			report(result)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if result.Error == nil && len(result.Groups) == 1 {
+				files := result.Groups[0].Files
+				lastPair = [2]string{files[0].Name, files[len(files)-1].Name}
+			}
+		}
+	}
+}
+
+// fileUnchanged reports whether the file is the same file with the same size and modification time as before.
+func fileUnchanged(fsys file_system.FS, name string, before os.FileInfo) bool {
+	fileStats, err := fsys.Stat(name)
+	return err == nil && os.SameFile(fileStats, before) &&
+		fileStats.Size() == before.Size() && fileStats.ModTime().Equal(before.ModTime())
+}
+
+// runWithTimeout is run limited by the timeout from the options. The result is recorded to the metrics if they are set.
+func runWithTimeout(ctx context.Context, fsys file_system.FS, logger *slog.Logger, opts runOptions, out io.Writer, metrics *runMetrics) *RunResult {
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	result := run(ctx, fsys, logger, opts, out)
+	metrics.observe(result)
+	return result
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"TestTask/pkg/file_system"
+)
+
+// zeroCopyStagePattern is the pattern of the names of the stage files of SwapTwoFilesZeroCopy.
+const zeroCopyStagePattern = ".swap-stage-*"
+
+// SwapTwoFilesZeroCopy swaps the contents of two files by copying them inside the kernel
+// with copy_file_range where it is supported, otherwise in userspace. The files of the filesystems
+// that aren't backed by the OS one are always copied in userspace.
+// The content of the first file is staged in a temporary file in its directory,
+// then the second file is copied to the first one and the staged content to the second one.
+// The contents are hashed before the swap and verified with SHA-256 after it like in SwapTwoFiles.
+// If an error occurs or the context is canceled, both files are restored to their original contents and sizes.
+// The swap is not journaled: if the process stops, the stage file is left and FindSwapStages reports it.
+// Returns true if all data was copied by the kernel.
+func SwapTwoFilesZeroCopy(ctx context.Context, fsys file_system.FS, path, firstName, secondName string) (bool, error) {
+	if err := checkDistinctFiles(fsys, path+firstName, path+secondName); err != nil {
+		return false, err
+	}
+
+	// The files are locked until they are closed
+	first, err := fsys.OpenFile(path+firstName, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer first.Close()
+	if err = lockFile(first); err != nil {
+		return false, err
+	}
+
+	second, err := fsys.OpenFile(path+secondName, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer second.Close()
+	if err = lockFile(second); err != nil {
+		return false, err
+	}
+
+	firstSize, err := fileSize(first)
+	if err != nil {
+		return false, err
+	}
+	secondSize, err := fileSize(second)
+	if err != nil {
+		return false, err
+	}
+
+	firstChecksum, err := readerSHA256(io.NewSectionReader(first, 0, firstSize))
+	if err != nil {
+		return false, err
+	}
+	secondChecksum, err := readerSHA256(io.NewSectionReader(second, 0, secondSize))
+	if err != nil {
+		return false, err
+	}
+
+	stage, err := fsys.CreateTemp(filepath.Dir(path+firstName), zeroCopyStagePattern)
+	if err != nil {
+		return false, err
+	}
+	defer fsys.Remove(stage.Name())
+	defer stage.Close()
+
+	// The first file is copied to the stage, the second one to the first one and the stage to the second one
+	// The copier feeds the progress itself, so it is removed from the context of copyRegion
+	c := &zeroCopier{ctx: contextWithProgress(ctx, nil), kernel: true, progress: progressFromContext(ctx)}
+	c.progress.addTotal(2*firstSize + secondSize)
+
+	if err = c.copy(stage, first, firstSize); err != nil {
+		return c.kernel, err
+	}
+
+	err = c.copy(first, second, secondSize)
+	if err == nil {
+		if err = c.copy(second, stage, firstSize); err == nil {
+			// The swap is reported only when the new contents are durable and verified
+			if err = first.Sync(); err == nil {
+				err = second.Sync()
+			}
+			if err == nil {
+				err = verifyChecksum(fsys, first.Name(), secondChecksum)
+			}
+			if err == nil {
+				err = verifyChecksum(fsys, second.Name(), firstChecksum)
+			}
+		}
+		if err != nil {
+			c.ctx, c.progress = context.Background(), nil
+			// The original content of the second file is in the first one
+			if rbErr := c.copy(second, first, secondSize); rbErr != nil {
+				return c.kernel, fmt.Errorf("%w (rollback failed: %s)", err, rbErr)
+			}
+		}
+	}
+	if err != nil {
+		// The rollback is not canceled and not counted in the progress
+		c.ctx, c.progress = context.Background(), nil
+		if rbErr := c.copy(first, stage, firstSize); rbErr != nil {
+			return c.kernel, fmt.Errorf("%w (rollback failed: %s)", err, rbErr)
+		}
+		return c.kernel, err
+	}
+	return c.kernel, nil
+}
+
+// FindSwapStages returns the stage files left by the zerocopy swaps interrupted in the root directory
+// and every subdirectory. The first file of such a swap may be overwritten, its original content is in the stage file,
+// so the stage files are not removed.
+func FindSwapStages(ctx context.Context, fsys file_system.FS, logger *slog.Logger, root string, opts SelectOptions) ([]string, error) {
+	var stages []string
+	err := walkDirs(ctx, fsys, logger, root, recoveryOptions(opts), func(dir string) error {
+		names, err := file_system.Glob(fsys, filepath.Join(root, dir), zeroCopyStagePattern)
+		stages = append(stages, names...)
+		return err
+	}, nil)
+	return stages, err
+}
+
+// zeroCopier copies whole files and tracks whether all data was copied by the kernel.
+type zeroCopier struct {
+	ctx      context.Context
+	kernel   bool
+	progress *swapProgress
+}
+
+// copy replaces the content of dst with the first size bytes of src.
+func (c *zeroCopier) copy(dst, src file_system.File, size int64) error {
+	var err error
+	dstFile, dstOk := file_system.OSFile(dst)
+	srcFile, srcOk := file_system.OSFile(src)
+	if dstOk && srcOk {
+		var kernel bool
+		kernel, err = copyFileRange(c.ctx, dstFile, srcFile, 0, size)
+		c.kernel = c.kernel && kernel
+	} else {
+		c.kernel = false
+		err = copyRegion(c.ctx, dst, src, 0, size, nil)
+	}
+	if err != nil {
+		return err
+	}
+	c.progress.addRead(size)
+	c.progress.addWritten(size)
+	return dst.Truncate(size)
+}
+
+// copyUserspace copies the region [offset, size) between the same offsets of the files in userspace.
+func copyUserspace(ctx context.Context, dst, src *os.File, offset, size int64) error {
+	return copyRegion(ctx, dst, src, offset, size, nil)
+}
+
+func fileSize(file file_system.File) (int64, error) {
+	fileStats, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileStats.Size(), nil
+}
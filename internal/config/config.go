@@ -4,6 +4,21 @@ import "github.com/ilyakaznacheev/cleanenv"
 
 type Config struct {
 	PathToFiles string `yaml:"path_to_files"`
+
+	// Pattern of the file names with the named group "num", e.g. app-(?P<num>-?\d+)\.txt.
+	// If the extensions are set, the pattern is matched against the name without the extension.
+	// If it is empty, the whole name without the extension must be a number.
+	FilePattern string `yaml:"file_pattern"`
+	// Extensions of the files. By default, .log is used if the pattern is not set.
+	Extensions      []string `yaml:"extensions"`
+	CaseInsensitive bool     `yaml:"case_insensitive"`
+
+	// Glob patterns of the files for the recursive mode. A pattern with a slash is matched against
+	// the path relative to PathToFiles, otherwise against the base name.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// Scan symlinked directories in the recursive mode.
+	FollowSymlinks bool `yaml:"follow_symlinks"`
 }
 
 func NewConfig(configPath string) (*Config, error) {
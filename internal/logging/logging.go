@@ -0,0 +1,11 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"math"
+)
+
+// Discard is the logger that discards the records without formatting them.
+// It is the default logger of the types that accept a logger optionally.
+var Discard = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
@@ -0,0 +1,152 @@
+package file_lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockPollInterval is the interval between the attempts to take a lock held by another process.
+const lockPollInterval = 50 * time.Millisecond
+
+var ErrLocked = errors.New("the file is locked by another process")
+
+// LockedError is returned if the lock is held by another process.
+// PID is 0 if the holder can't be determined.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("%s is locked by another process (PID %d)", e.Path, e.PID)
+	}
+	return fmt.Sprintf("%s is locked by another process", e.Path)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// TryLock takes an exclusive advisory lock of the file without waiting.
+// The lock is released by Unlock or when the file is closed.
+// If the lock is held by another process or by another descriptor of the file, *LockedError is returned.
+func TryLock(f *os.File) error {
+	locked, err := tryLock(f, false)
+	if err != nil {
+		return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+	if !locked {
+		return &LockedError{Path: f.Name(), PID: lockHolder(f)}
+	}
+	return nil
+}
+
+// Lock takes an exclusive advisory lock of the file, waiting for it up to wait.
+// If wait is 0, Lock fails immediately, if wait is negative, Lock waits until the context is canceled.
+func Lock(ctx context.Context, f *os.File, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		err := TryLock(f)
+		if !errors.Is(err, ErrLocked) || wait == 0 || (wait > 0 && time.Now().After(deadline)) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func Unlock(f *os.File) error {
+	if err := unlock(f); err != nil {
+		return &os.PathError{Op: "flock", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// FileLock is a lock file that contains the PID of the holder.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile creates the lock file if it doesn't exist and locks it like Lock.
+// If the holder can't be determined from the system, the PID is read from the file.
+func LockFile(ctx context.Context, name string, wait time.Duration) (*FileLock, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Lock(ctx, f, wait); err != nil {
+		var lockedErr *LockedError
+		if errors.As(err, &lockedErr) && lockedErr.PID == 0 {
+			lockedErr.PID = readPID(f)
+		}
+		_ = f.Close()
+		return nil, err
+	}
+
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &FileLock{file: f}, nil
+}
+
+// ProbeFile returns *LockedError if the lock file is locked by another process, it doesn't create the file
+// and doesn't hold the lock: a missing file isn't locked, an existing one is opened for reading
+// and locked with a shared lock for the time of the check, so the probes don't conflict with each other.
+func ProbeFile(name string) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	locked, err := tryLock(f, true)
+	if err != nil {
+		return &os.PathError{Op: "flock", Path: name, Err: err}
+	}
+	if !locked {
+		pid := lockHolder(f)
+		if pid == 0 {
+			pid = readPID(f)
+		}
+		return &LockedError{Path: name, PID: pid}
+	}
+	return nil
+}
+
+// Unlock clears the PID and releases the lock. The lock file is kept,
+// because removing it would let two processes lock different files with the same name.
+func (l *FileLock) Unlock() error {
+	err := l.file.Truncate(0)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func readPID(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,115 @@
+package file_lock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("advisory locks are not supported")
+	}
+
+	name := filepath.Join(t.TempDir(), "TestLock.log")
+	if err := os.WriteFile(name, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	assert.NoError(t, TryLock(first))
+
+	// Locks of different descriptors conflict even in the same process
+	err = TryLock(second)
+	assert.ErrorIs(t, err, ErrLocked)
+	var lockedErr *LockedError
+	if assert.True(t, errors.As(err, &lockedErr)) && runtime.GOOS == "linux" {
+		assert.Equal(t, os.Getpid(), lockedErr.PID)
+	}
+
+	// Waiting until the timeout
+	start := time.Now()
+	assert.ErrorIs(t, Lock(context.Background(), second, 3*lockPollInterval), ErrLocked)
+	assert.GreaterOrEqual(t, time.Since(start), 3*lockPollInterval)
+
+	// Waiting until the context is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 2*lockPollInterval)
+	defer cancel()
+	assert.ErrorIs(t, Lock(ctx, second, -1), context.DeadlineExceeded)
+
+	// Waiting until the lock is released
+	unlocked := make(chan struct{})
+	time.AfterFunc(2*lockPollInterval, func() {
+		_ = Unlock(first)
+		close(unlocked)
+	})
+	assert.NoError(t, Lock(context.Background(), second, time.Minute))
+	<-unlocked
+}
+
+func TestLockFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("advisory locks are not supported")
+	}
+
+	name := filepath.Join(t.TempDir(), ".swap.lock")
+
+	// The probe doesn't create the lock file
+	assert.NoError(t, ProbeFile(name))
+	_, err := os.Stat(name)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	lock, err := LockFile(context.Background(), name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(name)
+	assert.Equal(t, []byte(fmtPID(os.Getpid())), data)
+
+	_, err = LockFile(context.Background(), name, 0)
+	var lockedErr *LockedError
+	if assert.True(t, errors.As(err, &lockedErr)) {
+		assert.Equal(t, os.Getpid(), lockedErr.PID)
+		assert.Contains(t, err.Error(), "PID")
+	}
+
+	err = ProbeFile(name)
+	if assert.True(t, errors.As(err, &lockedErr)) {
+		assert.Equal(t, os.Getpid(), lockedErr.PID)
+	}
+
+	assert.NoError(t, lock.Unlock())
+	assert.NoError(t, ProbeFile(name))
+
+	// The lock file is kept
+	data, err = os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	lock, err = LockFile(context.Background(), name, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Unlock())
+}
+
+func fmtPID(pid int) string {
+	return strconv.Itoa(pid) + "\n"
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package file_lock
+
+import "os"
+
+// Advisory locks are supported only on Unix, mandatory locks on Windows would block the reads of the swap itself.
+
+func tryLock(f *os.File, shared bool) (bool, error) {
+	return true, nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package file_lock
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockHolder finds the PID of the process holding the flock of the file in /proc/locks.
+// Returns 0 if it isn't found.
+func lockHolder(f *os.File) int {
+	fileStats, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	sys, ok := fileStats.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	// Lines look like "1: FLOCK  ADVISORY  WRITE 29470 fe:00:9617441 0 EOF"
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(uint64(sys.Dev)), unix.Minor(uint64(sys.Dev)), sys.Ino)
+
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return 0
+	}
+	defer locks.Close()
+
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Waiting locks are marked with "->" after the number
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != id {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[4]); err == nil && pid > 0 {
+			return pid
+		}
+	}
+	return 0
+}
@@ -1,26 +1,46 @@
 package file_reader
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
+	"log/slog"
 	"os"
+
+	"TestTask/internal/logging"
+	"TestTask/pkg/file_system"
 )
 
 var (
 	ErrInvalidBlockSize = errors.New("invalid batch size")
 	ErrInvalidFileName  = errors.New("invalid file name")
+	ErrInvalidWhence    = errors.New("invalid whence")
+	ErrNegativeOffset   = errors.New("negative offset")
 )
 
+// FileReader reads a file opened for reading and writing.
+// It implements io.Reader, io.ReaderAt, io.WriterAt and io.Seeker.
+// The file is not locked, the callers that share it with other processes lock it themselves.
+//
+// Read doesn't read beyond the size of the file at the moment it was opened or truncated,
+// so the file can be overwritten and extended by WriteAt while it is being read.
 type FileReader struct {
-	label  string
-	file   *os.File
-	name   string
+	file   file_system.File
 	size   int64
 	offset int64
 	eof    bool
-	buf    []byte
+	// SHA-256 of the bytes read by Read since the last change of the position by Seek
+	hash   hash.Hash
+	logger *slog.Logger
+	// Buffer of ReadBytes, nil if the reader was opened by OpenFileReader
+	buf []byte
 }
 
+// NewFileReader opens the file of the OS filesystem. ReadBytes reads blocks of readBlockSize bytes.
+//
+// Deprecated: Use OpenFileReader with file_system.OS and Read.
 func NewFileReader(fileName string, readBlockSize int) (*FileReader, error) {
 	if len(fileName) == 0 {
 		return nil, ErrInvalidFileName
@@ -29,73 +49,182 @@ func NewFileReader(fileName string, readBlockSize int) (*FileReader, error) {
 		return nil, ErrInvalidBlockSize
 	}
 
-	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	r, err := OpenFileReader(file_system.OS, fileName)
+	if err != nil {
+		return nil, err
+	}
+	r.buf = make([]byte, readBlockSize)
+	return r, nil
+}
+
+// OpenFileReader opens the file of the filesystem.
+func OpenFileReader(fsys file_system.FS, fileName string) (*FileReader, error) {
+	if len(fileName) == 0 {
+		return nil, ErrInvalidFileName
+	}
+
+	file, err := fsys.OpenFile(fileName, os.O_RDWR, 0)
 	if err != nil {
 		return nil, err
 	}
 
 	var fileStats os.FileInfo
 	if fileStats, err = file.Stat(); err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
-	buf := make([]byte, readBlockSize)
-
 	return &FileReader{
 		file:   file,
-		name:   file.Name(),
 		size:   fileStats.Size(),
 		offset: 0,
 		eof:    false,
-		buf:    buf,
+		hash:   sha256.New(),
+		logger: logging.Discard,
 	}, nil
 }
 
-func (r *FileReader) GetFile() *os.File {
+// SetLogger sets the logger of the reader. By default, the records are discarded.
+func (r *FileReader) SetLogger(logger *slog.Logger) {
+	r.logger = logger.With("file", r.file.Name())
+	r.logger.Debug("file opened", "size", r.size)
+}
+
+// File returns the file of the reader, e.g. to lock it. The position of Read is not affected by the file.
+func (r *FileReader) File() file_system.File {
 	return r.file
 }
 
+// GetFile returns the file of the OS filesystem or nil if the file is of another filesystem.
+//
+// Deprecated: Use File or the methods of the reader.
+func (r *FileReader) GetFile() *os.File {
+	osFile, _ := file_system.OSFile(r.file)
+	return osFile
+}
+
 func (r *FileReader) Name() string {
 	return r.file.Name()
 }
 
+// Size returns the size of the file at the moment it was opened or truncated.
 func (r *FileReader) Size() int64 {
 	return r.size
 }
 
+// EOF reports whether Read has returned io.EOF.
 func (r *FileReader) EOF() bool {
 	return r.eof
 }
 
-func (r *FileReader) ReadBytes() (int, []byte, error) {
-	n, err := r.file.ReadAt(r.buf, r.offset)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return n, nil, err
-	} else if errors.Is(err, io.EOF) && n == 0 {
+// Read reads the next bytes of the file.
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
 		r.eof = true
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.offset; remaining < int64(len(p)) {
+		p = p[:remaining]
 	}
 
+	n, err := r.file.ReadAt(p, r.offset)
+	r.hash.Write(p[:n])
 	r.offset += int64(n)
-	if r.offset > r.size {
+
+	if errors.Is(err, io.EOF) {
+		// The file was truncated by someone else, the remaining bytes are read by the next call
+		if n > 0 {
+			return n, nil
+		}
+		r.logger.Warn("file truncated while reading", "offset", r.offset, "size", r.size)
 		r.eof = true
 	}
+	return n, err
+}
+
+// ReadBytes reads the next block of the size passed to NewFileReader and returns the internal buffer,
+// which is overwritten by the next call. Returns ErrInvalidBlockSize if the reader was opened by OpenFileReader.
+//
+// Deprecated: Use Read.
+func (r *FileReader) ReadBytes() (int, []byte, error) {
+	if r.buf == nil {
+		return 0, nil, ErrInvalidBlockSize
+	}
+	n, err := r.Read(r.buf)
 	return n, r.buf, err
 }
 
+// ReadContext is Read that returns the error of the context if it is canceled.
+func (r *FileReader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Read(p)
+}
+
+// ReadAt reads len(p) bytes at the offset. It doesn't change the position of Read.
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.file.ReadAt(p, off)
+}
+
+// WriteAt writes len(p) bytes at the offset. It doesn't change the position of Read and the size returned by Size.
+func (r *FileReader) WriteAt(p []byte, off int64) (int, error) {
+	return r.file.WriteAt(p, off)
+}
+
+// Seek sets the position of the next Read. io.SeekEnd is relative to Size.
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, ErrInvalidWhence
+	}
+	if offset < 0 {
+		return r.offset, ErrNegativeOffset
+	}
+
+	if offset != r.offset {
+		r.logger.Debug("position changed, checksum reset", "offset", offset)
+		r.offset = offset
+		r.hash.Reset()
+	}
+	r.eof = false
+	return r.offset, nil
+}
+
+// SetOffset sets the position of the next Read, negative offsets are ignored.
+//
+// Deprecated: Use Seek.
 func (r *FileReader) SetOffset(newOffset int64) {
 	if newOffset >= 0 {
-		r.offset = newOffset
+		_, _ = r.Seek(newOffset, io.SeekStart)
 	}
 }
 
+// Checksum returns the SHA-256 of the bytes read by Read.
+// After the whole file is read from the beginning, it is the checksum of the file content.
+func (r *FileReader) Checksum() []byte {
+	return r.hash.Sum(nil)
+}
+
 func (r *FileReader) Truncate(newSize int64) error {
 	if err := r.file.Truncate(newSize); err != nil {
 		return err
 	}
+	r.logger.Debug("file truncated", "size", newSize)
 	r.size = newSize
 	return nil
 }
 
+func (r *FileReader) Sync() error {
+	return r.file.Sync()
+}
+
 func (r *FileReader) Close() error {
+	r.logger.Debug("file closed", "read", r.offset)
 	return r.file.Close()
 }
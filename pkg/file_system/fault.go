@@ -0,0 +1,246 @@
+package file_system
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Operations of the files that can fail.
+const (
+	OpRead     = "read"     // Read and ReadAt
+	OpWrite    = "write"    // Write and WriteAt
+	OpTruncate = "truncate" // Truncate of a file and of FS
+	OpSync     = "sync"
+	OpRename   = "rename" // Rename of FS, Name is matched against the old name
+)
+
+// Fault describes when and how an operation of the files of FaultFS fails.
+type Fault struct {
+	Op string
+	// Name is a pattern of filepath.Match matched against the base name of the file, empty matches any file.
+	Name string
+	// Offset, if positive, limits the fault to the reads and writes of the bytes at the offset and beyond
+	// and to the truncations to a bigger size.
+	Offset int64
+	// Call is the number of the matching operation that fails starting from 1, zero fails the first one.
+	Call int
+	// Repeat fails every matching operation starting from the Call one, otherwise the fault is injected once,
+	// so the rollback after it succeeds. A repeated write fault at an offset with ENOSPC is a full disk.
+	Repeat bool
+	// Short makes a failing read or write transfer the bytes before the offset, or a half of the bytes
+	// if the offset isn't set, before the error is returned.
+	Short bool
+	// Corrupt makes a failing write succeed with the first byte inverted: a silent corruption of the data.
+	Corrupt bool
+	// Err is the error of the operation, syscall.EIO by default.
+	Err error
+
+	calls int
+	fired int
+}
+
+// FaultFS is the filesystem that injects the faults into the operations of the files of the wrapped filesystem
+// and into the renames.
+// It is safe for concurrent use, the faults are matched in the order they were added.
+//
+// The wrapped filesystem and files are returned by Unwrap, so FaultFS of OS has the features of OS.
+// The data copied by the kernel with copy_file_range bypasses the read and write faults.
+type FaultFS struct {
+	FS
+
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+func NewFaultFS(fsys FS, faults ...*Fault) *FaultFS {
+	return &FaultFS{FS: fsys, faults: faults}
+}
+
+// Unwrap returns the wrapped filesystem.
+func (f *FaultFS) Unwrap() FS {
+	return f.FS
+}
+
+// Inject adds the fault.
+func (f *FaultFS) Inject(fault *Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = append(f.faults, fault)
+}
+
+// Fired returns the number of the operations failed by the fault.
+func (f *FaultFS) Fired(fault *Fault) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fault.fired
+}
+
+// fault returns the fault injected into the operation of the named file with the bytes [off, end),
+// for a truncation off is the new size.
+func (f *FaultFS) fault(op, name string, off, end int64) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fault := range f.faults {
+		if fault.Op != op || (!fault.Repeat && fault.fired > 0) {
+			continue
+		}
+		if fault.Name != "" {
+			if matched, _ := filepath.Match(fault.Name, filepath.Base(name)); !matched {
+				continue
+			}
+		}
+		if fault.Offset > 0 && end <= fault.Offset {
+			continue
+		}
+
+		fault.calls++
+		if fault.calls < fault.Call {
+			continue
+		}
+		fault.fired++
+		return fault
+	}
+	return nil
+}
+
+// error returns the error of the failed operation.
+func (fault *Fault) error(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: fault.errno()}
+}
+
+func (fault *Fault) errno() error {
+	if fault.Err == nil {
+		return syscall.EIO
+	}
+	return fault.Err
+}
+
+// corrupted returns a copy of p with the first byte inverted.
+func corrupted(p []byte) []byte {
+	c := append([]byte(nil), p...)
+	if len(c) > 0 {
+		c[0] ^= 0xff
+	}
+	return c
+}
+
+// shortLength returns the number of the bytes of [off, off+n) transferred before the error.
+func (fault *Fault) shortLength(off int64, n int) int {
+	switch {
+	case !fault.Short:
+		return 0
+	case fault.Offset <= 0:
+		return n / 2
+	case fault.Offset <= off:
+		return 0
+	default:
+		return int(fault.Offset - off)
+	}
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) CreateTemp(dir, pattern string) (File, error) {
+	file, err := f.FS.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Truncate(name string, size int64) error {
+	if fault := f.fault(OpTruncate, name, size, size); fault != nil {
+		return fault.error("truncate", name)
+	}
+	return f.FS.Truncate(name, size)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if fault := f.fault(OpRename, oldpath, 0, 0); fault != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fault.errno()}
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+// faultFile is a file of FaultFS.
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+// Unwrap returns the wrapped file.
+func (f *faultFile) Unwrap() File {
+	return f.File
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if fault := f.fs.fault(OpRead, f.Name(), off, off+int64(len(p))); fault != nil {
+		n, _ := f.File.Read(p[:fault.shortLength(off, len(p))])
+		return n, fault.error("read", f.Name())
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if fault := f.fs.fault(OpRead, f.Name(), off, off+int64(len(p))); fault != nil {
+		n, _ := f.File.ReadAt(p[:fault.shortLength(off, len(p))], off)
+		return n, fault.error("read", f.Name())
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if fault := f.fs.fault(OpWrite, f.Name(), off, off+int64(len(p))); fault != nil {
+		if fault.Corrupt {
+			return f.File.Write(corrupted(p))
+		}
+		n, _ := f.File.Write(p[:fault.shortLength(off, len(p))])
+		return n, fault.error("write", f.Name())
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if fault := f.fs.fault(OpWrite, f.Name(), off, off+int64(len(p))); fault != nil {
+		if fault.Corrupt {
+			return f.File.WriteAt(corrupted(p), off)
+		}
+		n, _ := f.File.WriteAt(p[:fault.shortLength(off, len(p))], off)
+		return n, fault.error("write", f.Name())
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault := f.fs.fault(OpTruncate, f.Name(), size, size); fault != nil {
+		return fault.error("truncate", f.Name())
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if fault := f.fs.fault(OpSync, f.Name(), 0, 0); fault != nil {
+		return fault.error("sync", f.Name())
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,195 @@
+package file_system
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FS is a filesystem the files are selected, read and written in.
+// Names are paths in the form accepted by the os package, the errors are *os.PathError or *os.LinkError
+// wrapping the same errors as the os package returns, so errors.Is(err, os.ErrNotExist) works for every FS.
+type FS interface {
+	// OpenFile opens the named file with the flags of os.OpenFile. A directory can be opened read-only to read its entries.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// CreateTemp creates a new file like os.CreateTemp. If dir is empty, the file is created in TempDir.
+	CreateTemp(dir, pattern string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	// Lstat is Stat that doesn't follow a symbolic link.
+	Lstat(name string) (os.FileInfo, error)
+	// EvalSymlinks returns the name after the evaluation of the symbolic links like filepath.EvalSymlinks.
+	EvalSymlinks(name string) (string, error)
+	Truncate(name string, size int64) error
+	// Rename moves the file or the directory, an existing file at the new name is replaced.
+	Rename(oldName, newName string) error
+	// Remove removes the file or the empty directory.
+	Remove(name string) error
+	// TempDir is the directory for the temporary files.
+	TempDir() string
+}
+
+// File is an open file of FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	// ReadDir reads the entries of the directory in the order of the filesystem like os.File.ReadDir.
+	ReadDir(n int) ([]os.DirEntry, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// OS is the filesystem of the operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+// IsOS reports whether the names of the filesystem are the paths of the OS filesystem: it is OS or wraps OS
+// like FaultFS. The features that work with the paths directly, like the advisory locks, the metadata,
+// the atomic exchange and the free space, are available only on such filesystems.
+func IsOS(fsys FS) bool {
+	for {
+		switch f := fsys.(type) {
+		case osFS:
+			return true
+		case interface{ Unwrap() FS }:
+			fsys = f.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// OSFile returns the file of the OS filesystem the file is or wraps like the files of FaultFS.
+// It is used by the syscalls that need a file descriptor, like flock and copy_file_range.
+func OSFile(f File) (*os.File, bool) {
+	for {
+		switch file := f.(type) {
+		case *os.File:
+			return file, true
+		case interface{ Unwrap() File }:
+			f = file.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// A nil *os.File must not become a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) CreateTemp(dir, pattern string) (File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) TempDir() string {
+	return os.TempDir()
+}
+
+// Open opens the named file for reading.
+func Open(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// ReadFile returns the content of the named file.
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// WriteFile writes the data to the named file, creating it with the permissions if necessary.
+func WriteFile(fsys FS, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadDir returns the entries of the named directory sorted by name.
+func ReadDir(fsys FS, name string) ([]os.DirEntry, error) {
+	f, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
+
+// Glob returns the names of the files of the directory whose base names match the pattern
+// with the syntax of filepath.Match. A missing directory has no matches.
+func Glob(fsys FS, dir, pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	entries, err := ReadDir(fsys, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if matched, _ := filepath.Match(pattern, entry.Name()); matched {
+			names = append(names, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,297 @@
+package file_system
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFS checks that MemFS behaves like the OS filesystem.
+func TestFS(t *testing.T) {
+	mem := NewMemFS()
+	if err := mem.MkdirAll("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		fsys FS
+		dir  string
+	}{
+		"os":  {OS, t.TempDir()},
+		"mem": {mem, "/data"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testFS(t, tc.fsys, tc.dir)
+		})
+	}
+}
+
+func testFS(t *testing.T, fsys FS, dir string) {
+	name := filepath.Join(dir, "1.log")
+
+	// Files are not created without O_CREATE
+	_, err := fsys.OpenFile(name, os.O_RDWR, 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = fsys.OpenFile(filepath.Join(dir, "missing", "1.log"), os.O_RDWR|os.O_CREATE, 0600)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.NoError(t, WriteFile(fsys, name, []byte("first line\n"), 0600))
+	_, err = fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	assert.ErrorIs(t, err, os.ErrExist)
+
+	f, err := fsys.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing beyond the end extends the file, reading beyond the end returns io.EOF
+	n, err := f.WriteAt([]byte("second"), 11)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	buf := make([]byte, 8)
+	n, err = f.ReadAt(buf, 13)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "cond", string(buf[:n]))
+
+	// Read and Write use the position set by Seek
+	pos, err := f.Seek(-6, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 11, pos)
+	n, err = f.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(buf[:n]))
+	_, err = f.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = f.Write([]byte(" line\n"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Truncate(5))
+	fileStats, err := f.Stat()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.log", fileStats.Name())
+		assert.EqualValues(t, 5, fileStats.Size())
+		assert.False(t, fileStats.IsDir())
+	}
+	assert.NoError(t, f.Sync())
+	assert.NoError(t, f.Close())
+	assert.ErrorIs(t, f.Close(), os.ErrClosed)
+
+	data, err := ReadFile(fsys, name)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	// A read-only file can't be written
+	f, err = Open(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("x"), 0)
+	assert.Error(t, err)
+	assert.NoError(t, f.Close())
+
+	assert.NoError(t, fsys.Truncate(name, 2))
+	fileStats, err = fsys.Stat(name)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2, fileStats.Size())
+	}
+
+	// Temporary files get unique names
+	first, err := fsys.CreateTemp(dir, ".swap-*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := fsys.CreateTemp(dir, ".swap-*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	assert.NotEqual(t, first.Name(), second.Name())
+	assert.Equal(t, dir, filepath.Dir(first.Name()))
+	_, err = fsys.CreateTemp(dir, "a/*")
+	assert.Error(t, err)
+
+	temp, err := fsys.CreateTemp("", "swap-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Clean(fsys.TempDir()), filepath.Dir(temp.Name()))
+	assert.NoError(t, temp.Close())
+	assert.NoError(t, fsys.Remove(temp.Name()))
+
+	// Renaming replaces the existing file
+	assert.NoError(t, fsys.Rename(first.Name(), name))
+	_, err = fsys.Stat(first.Name())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	fileStats, err = fsys.Lstat(name)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 0, fileStats.Size())
+	}
+	var linkErr *os.LinkError
+	assert.True(t, errors.As(fsys.Rename(first.Name(), name), &linkErr))
+
+	// The entries of a directory are read in batches
+	subdir := filepath.Join(dir, "sub")
+	if mem, ok := fsys.(*MemFS); ok {
+		assert.NoError(t, mem.MkdirAll(subdir, 0755))
+	} else {
+		assert.NoError(t, os.Mkdir(subdir, 0755))
+	}
+	assert.NoError(t, WriteFile(fsys, filepath.Join(subdir, "2.log"), nil, 0600))
+
+	d, err := Open(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		entries, err := d.ReadDir(1)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if !assert.NoError(t, err) || !assert.Len(t, entries, 1) {
+			break
+		}
+		names = append(names, entries[0].Name())
+		if entries[0].Name() == "sub" {
+			assert.True(t, entries[0].IsDir())
+		}
+	}
+	assert.NoError(t, d.Close())
+	assert.ElementsMatch(t, []string{"1.log", filepath.Base(second.Name()), "sub"}, names)
+
+	matches, err := Glob(fsys, dir, ".swap-*.tmp")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{second.Name()}, matches)
+
+	// Directories are moved with their entries and removed only when empty
+	moved := filepath.Join(dir, "moved")
+	assert.NoError(t, fsys.Rename(subdir, moved))
+	data, err = ReadFile(fsys, filepath.Join(moved, "2.log"))
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	assert.Error(t, fsys.Remove(moved))
+	assert.NoError(t, fsys.Remove(filepath.Join(moved, "2.log")))
+	assert.NoError(t, fsys.Remove(moved))
+
+	realName, err := fsys.EvalSymlinks(name)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.log", filepath.Base(realName))
+	_, err = fsys.EvalSymlinks(moved)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestMemFSOpenFiles(t *testing.T) {
+	fsys := NewMemFS()
+	assert.NoError(t, WriteFile(fsys, "1.log", []byte("data"), 0600))
+
+	f, err := fsys.OpenFile("1.log", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	assert.NoError(t, WriteFile(fsys, "2.log", nil, 0600))
+
+	// An open file keeps its content after it's renamed or removed
+	assert.NoError(t, fsys.Rename("1.log", "2.log"))
+	assert.NoError(t, fsys.Remove("2.log"))
+	_, err = f.WriteAt([]byte("new "), 0)
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "new ", string(buf))
+
+	// Directories are read-only
+	_, err = fsys.OpenFile(".", os.O_RDWR, 0)
+	assert.Error(t, err)
+	_, err = fsys.OpenFile("/", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	assert.Error(t, fsys.Remove("/"))
+	assert.NoError(t, fsys.MkdirAll(filepath.Join(fsys.TempDir(), "a", "b"), 0755))
+	assert.NoError(t, WriteFile(fsys, "3.log", nil, 0600))
+	assert.Error(t, fsys.MkdirAll(filepath.Join("3.log", "a"), 0755))
+}
+
+func TestFaultFS(t *testing.T) {
+	mem := NewMemFS()
+	assert.NoError(t, WriteFile(mem, "1.log", []byte("0123456789"), 0600))
+
+	enospc := &Fault{Op: OpWrite, Name: "*.log", Offset: 12, Repeat: true, Short: true, Err: syscall.ENOSPC}
+	readFault := &Fault{Op: OpRead, Call: 2}
+	truncateFault := &Fault{Op: OpTruncate, Offset: 5}
+	fsys := NewFaultFS(mem, enospc, readFault, truncateFault)
+
+	f, err := fsys.OpenFile("1.log", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The second read fails once
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	_, err = f.ReadAt(buf, 0)
+	assert.ErrorIs(t, err, syscall.EIO)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fsys.Fired(readFault))
+
+	// Writes beyond the offset fail every time, the bytes before it are written
+	_, err = f.WriteAt([]byte("ab"), 0)
+	assert.NoError(t, err)
+	n, err := f.WriteAt([]byte("abcd"), 10)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, 2, n)
+	_, err = f.Write([]byte("abcdefghijklmn"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, 2, fsys.Fired(enospc))
+
+	// A corrupting write succeeds
+	fsys.Inject(&Fault{Op: OpWrite, Name: "1.log", Corrupt: true})
+	_, err = f.WriteAt([]byte("xy"), 0)
+	assert.NoError(t, err)
+	_, err = f.ReadAt(buf[:2], 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'x' ^ 0xff, 'y'}, buf[:2])
+	_, err = f.WriteAt([]byte("ab"), 0)
+	assert.NoError(t, err)
+
+	// Truncations to a smaller size than the offset succeed
+	assert.NoError(t, f.Truncate(4))
+	assert.ErrorIs(t, fsys.Truncate("1.log", 6), syscall.EIO)
+	assert.NoError(t, fsys.Truncate("1.log", 6))
+
+	data, err := ReadFile(mem, "1.log")
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd\x00\x00", string(data))
+
+	// Renames fail by the old name
+	fsys.Inject(&Fault{Op: OpRename, Name: "1.log", Err: syscall.EXDEV})
+	assert.ErrorIs(t, fsys.Rename("1.log", "2.log"), syscall.EXDEV)
+	assert.NoError(t, fsys.Rename("1.log", "2.log"))
+	assert.NoError(t, fsys.Rename("2.log", "1.log"))
+
+	// The features of the wrapped filesystem are available through Unwrap
+	assert.False(t, IsOS(fsys))
+	_, ok := OSFile(f)
+	assert.False(t, ok)
+
+	fsys = NewFaultFS(OS)
+	assert.True(t, IsOS(fsys))
+	f, err = fsys.CreateTemp(t.TempDir(), "fault-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	osFile, ok := OSFile(f)
+	if assert.True(t, ok) {
+		assert.Equal(t, f.Name(), osFile.Name())
+	}
+}
@@ -0,0 +1,561 @@
+package file_system
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memTempDir is the TempDir of MemFS.
+var memTempDir = filepath.Join(string(filepath.Separator), "tmp")
+
+var errPatternHasSeparator = errors.New("pattern contains path separator")
+
+// MemFS is a filesystem kept in memory. It is safe for concurrent use.
+//
+// Names are cleaned with filepath.Clean, relative and absolute names are separate trees
+// with the roots "." and "/". MemFS has no symbolic links and doesn't check the permissions.
+// Files stay readable and writable after they are renamed or removed until they are closed, like on Unix.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	// Number of the last temporary file, used to generate unique names
+	temp int
+}
+
+type memNode struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+// NewMemFS returns an empty filesystem with the TempDir directory.
+func NewMemFS() *MemFS {
+	m := &MemFS{nodes: map[string]*memNode{}}
+	_ = m.MkdirAll(memTempDir, 0700)
+	return m
+}
+
+// MkdirAll creates the directory and all its missing parents like os.MkdirAll.
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The missing directories from the deepest one
+	var missing []string
+	for dir := filepath.Clean(name); ; dir = filepath.Dir(dir) {
+		if n, ok := m.node(dir); ok {
+			if !n.isDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		m.nodes[missing[i]] = &memNode{mode: os.ModeDir | perm&os.ModePerm, modTime: time.Now()}
+	}
+	return nil
+}
+
+// node returns the node of the cleaned name. The roots always exist.
+func (m *MemFS) node(name string) (*memNode, bool) {
+	n, ok := m.nodes[name]
+	if !ok && filepath.Dir(name) == name {
+		n = &memNode{mode: os.ModeDir | 0755, modTime: time.Now()}
+		m.nodes[name] = n
+		ok = true
+	}
+	return n, ok
+}
+
+// checkParent returns an error if the parent of the cleaned name isn't an existing directory.
+func (m *MemFS) checkParent(name string) error {
+	parent, ok := m.node(filepath.Dir(name))
+	if !ok {
+		return syscall.ENOENT
+	}
+	if !parent.isDir() {
+		return syscall.ENOTDIR
+	}
+	return nil
+}
+
+// children returns the sorted names of the entries of the cleaned directory name.
+func (m *MemFS) children(name string) []string {
+	var names []string
+	for child := range m.nodes {
+		if child != name && filepath.Dir(child) == name {
+			names = append(names, child)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.openFile(name, flag, perm)
+}
+
+func (m *MemFS) openFile(name string, flag int, perm os.FileMode) (*memFile, error) {
+	cleanName := filepath.Clean(name)
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+
+	n, ok := m.node(cleanName)
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	case !ok:
+		if err := m.checkParent(cleanName); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		n = &memNode{mode: perm & os.ModePerm, modTime: time.Now()}
+		m.nodes[cleanName] = n
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	case n.isDir() && access != os.O_RDONLY:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case flag&os.O_TRUNC != 0 && access != os.O_RDONLY:
+		n.data = nil
+		n.modTime = time.Now()
+	}
+
+	return &memFile{
+		fs:     m,
+		name:   name,
+		node:   n,
+		read:   access != os.O_WRONLY,
+		write:  access != os.O_RDONLY,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *MemFS) CreateTemp(dir, pattern string) (File, error) {
+	if dir == "" {
+		dir = m.TempDir()
+	}
+	if strings.ContainsRune(pattern, filepath.Separator) || strings.ContainsRune(pattern, '/') {
+		return nil, &os.PathError{Op: "createtemp", Path: pattern, Err: errPatternHasSeparator}
+	}
+
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		m.temp++
+		name := filepath.Join(dir, prefix+strconv.Itoa(m.temp)+suffix)
+		f, err := m.openFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, os.ErrExist) {
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
+		}
+	}
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	return m.stat("stat", name)
+}
+
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	return m.stat("lstat", name)
+}
+
+func (m *MemFS) stat(op, name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.node(filepath.Clean(name))
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+	return newMemFileInfo(name, n), nil
+}
+
+// EvalSymlinks returns the cleaned name of an existing file, there are no symbolic links.
+func (m *MemFS) EvalSymlinks(name string) (string, error) {
+	if _, err := m.Lstat(name); err != nil {
+		return "", err
+	}
+	return filepath.Clean(name), nil
+}
+
+func (m *MemFS) Truncate(name string, size int64) error {
+	f, err := m.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Truncate(size)
+}
+
+func (m *MemFS) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+
+	oldClean, newClean := filepath.Clean(oldName), filepath.Clean(newName)
+	n, ok := m.node(oldClean)
+	if !ok {
+		return linkError(syscall.ENOENT)
+	}
+	if oldClean == newClean {
+		return nil
+	}
+	if filepath.Dir(oldClean) == oldClean || strings.HasPrefix(newClean, oldClean+string(filepath.Separator)) {
+		return linkError(syscall.EINVAL)
+	}
+	if err := m.checkParent(newClean); err != nil {
+		return linkError(err)
+	}
+
+	if target, ok := m.node(newClean); ok {
+		switch {
+		case target.isDir() && !n.isDir():
+			return linkError(syscall.EISDIR)
+		case !target.isDir() && n.isDir():
+			return linkError(syscall.ENOTDIR)
+		case target.isDir() && len(m.children(newClean)) > 0:
+			return linkError(syscall.ENOTEMPTY)
+		}
+	}
+
+	// The entries of a directory are moved with it
+	prefix := oldClean + string(filepath.Separator)
+	var moved []string
+	for name := range m.nodes {
+		if strings.HasPrefix(name, prefix) {
+			moved = append(moved, name)
+		}
+	}
+	for _, name := range moved {
+		m.nodes[newClean+string(filepath.Separator)+name[len(prefix):]] = m.nodes[name]
+		delete(m.nodes, name)
+	}
+	delete(m.nodes, oldClean)
+	m.nodes[newClean] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cleanName := filepath.Clean(name)
+	n, ok := m.node(cleanName)
+	switch {
+	case !ok:
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOENT}
+	case filepath.Dir(cleanName) == cleanName:
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	case n.isDir() && len(m.children(cleanName)) > 0:
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	delete(m.nodes, cleanName)
+	return nil
+}
+
+func (m *MemFS) TempDir() string {
+	return memTempDir
+}
+
+// memFile is an open file of MemFS. Its state is guarded by the mutex of the filesystem.
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	offset int64
+	closed bool
+
+	read, write, append bool
+
+	// Entries of the directory not returned by ReadDir yet, listed on the first call
+	entries []os.DirEntry
+	listed  bool
+}
+
+// check returns the error of the operation if the file is closed or opened without the access.
+// The mutex must be held.
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	case write && !f.write, !write && !f.read:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	case f.node.isDir() && op != "readdir":
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 {
+		// Like io.Reader, a short read is not an error
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	f.writeAt(p, f.offset)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.append {
+		return 0, errors.New("os: invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.writeAt(p, off)
+	return len(p), nil
+}
+
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.resize(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+}
+
+// resize truncates or extends the data with zeros.
+func (f *memFile) resize(size int64) {
+	if size <= int64(cap(f.node.data)) {
+		old := len(f.node.data)
+		f.node.data = f.node.data[:size]
+		if int(size) > old {
+			clear(f.node.data[old:])
+		}
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, f.node.data)
+	f.node.data = data
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return newMemFileInfo(f.name, f.node), nil
+}
+
+func (f *memFile) ReadDir(n int) ([]os.DirEntry, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("readdir", false); err != nil {
+		return nil, err
+	}
+	if !f.node.isDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	if !f.listed {
+		for _, child := range f.fs.children(filepath.Clean(f.name)) {
+			info := newMemFileInfo(child, f.fs.nodes[child])
+			f.entries = append(f.entries, fs.FileInfoToDirEntry(info))
+		}
+		f.listed = true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.resize(size)
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// Sync does nothing, the data is never lost.
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// memFileInfo is the state of a node at the moment of the Stat call.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemFileInfo(name string, n *memNode) *memFileInfo {
+	return &memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+func (i *memFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memFileInfo) Mode() os.FileMode {
+	return i.mode
+}
+
+func (i *memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memFileInfo) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+func (i *memFileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,197 @@
+package num_name
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotNumber     = errors.New("not a decimal number")
+	ErrExponentRange = errors.New("exponent is out of range")
+)
+
+// The exponent is limited, so the position of the decimal point always fits into int64.
+const maxExponent = 1 << 60
+
+// Plain notation is used in String for numbers with at most maxPlainZeros trailing zeros.
+const maxPlainZeros = 32
+
+// Number is a decimal number of arbitrary precision.
+// It is stored in a normalized form: the value is 0.digits * 10^exp,
+// digits has no leading and trailing zeros and is empty for zero.
+// Zero has no sign.
+type Number struct {
+	neg    bool
+	digits string
+	exp    int64
+}
+
+// Parse parses a decimal integer with an optional minus sign, e.g. "-0012".
+func Parse(s string) (Number, error) {
+	neg, s := cutSign(s)
+	if !isDigits(s) {
+		return Number{}, ErrNotNumber
+	}
+	return newNumber(neg, s, int64(len(s))), nil
+}
+
+// ParseDecimal parses a decimal number with an optional minus sign, fraction and exponent,
+// e.g. "-2.5", "3.14", "1e6" or "1.5E-3". The value is exact, no float rounding is made.
+func ParseDecimal(s string) (Number, error) {
+	neg, s := cutSign(s)
+
+	mantissa, exponent, hasExponent := s, "", false
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa, exponent, hasExponent = s[:i], s[i+1:], true
+	}
+
+	intPart, fracPart := mantissa, ""
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		intPart, fracPart = mantissa[:i], mantissa[i+1:]
+		if !isDigits(fracPart) {
+			return Number{}, ErrNotNumber
+		}
+	}
+	if !isDigits(intPart) {
+		return Number{}, ErrNotNumber
+	}
+
+	var exp int64
+	if hasExponent {
+		var err error
+		if exp, err = parseExponent(exponent); err != nil {
+			return Number{}, err
+		}
+	}
+
+	return newNumber(neg, intPart+fracPart, int64(len(intPart))+exp), nil
+}
+
+func cutSign(s string) (bool, string) {
+	if strings.HasPrefix(s, "-") {
+		return true, s[1:]
+	}
+	return false, s
+}
+
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseExponent(s string) (int64, error) {
+	digits := s
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		digits = s[1:]
+	}
+	if !isDigits(digits) {
+		return 0, ErrNotNumber
+	}
+
+	exp, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || exp > maxExponent || exp < -maxExponent {
+		return 0, ErrExponentRange
+	}
+	return exp, nil
+}
+
+// newNumber normalizes the number 0.digits * 10^exp.
+func newNumber(neg bool, digits string, exp int64) Number {
+	trimmed := strings.TrimLeft(digits, "0")
+	exp -= int64(len(digits) - len(trimmed))
+	trimmed = strings.TrimRight(trimmed, "0")
+
+	if trimmed == "" {
+		// Negative zero is equal to zero
+		return Number{}
+	}
+	return Number{neg: neg, digits: trimmed, exp: exp}
+}
+
+// String returns the normalized form of the number.
+// Integers and fractions are written in plain notation, very big and very small numbers in scientific notation.
+func (n Number) String() string {
+	if n.digits == "" {
+		return "0"
+	}
+
+	var b strings.Builder
+	if n.neg {
+		b.WriteByte('-')
+	}
+
+	length := int64(len(n.digits))
+	switch {
+	case n.exp >= length && n.exp-length <= maxPlainZeros:
+		b.WriteString(n.digits)
+		b.WriteString(strings.Repeat("0", int(n.exp-length)))
+	case n.exp > 0 && n.exp < length:
+		b.WriteString(n.digits[:n.exp])
+		b.WriteByte('.')
+		b.WriteString(n.digits[n.exp:])
+	case n.exp <= 0 && -n.exp <= maxPlainZeros:
+		b.WriteString("0.")
+		b.WriteString(strings.Repeat("0", int(-n.exp)))
+		b.WriteString(n.digits)
+	default:
+		b.WriteString(n.digits[:1])
+		if length > 1 {
+			b.WriteByte('.')
+			b.WriteString(n.digits[1:])
+		}
+		b.WriteByte('e')
+		b.WriteString(strconv.FormatInt(n.exp-1, 10))
+	}
+	return b.String()
+}
+
+// Compare returns -1, 0 or +1 depending on whether a is less than, equal to or greater than b.
+func Compare(a, b Number) int {
+	if c := compareInts(a.sign(), b.sign()); c != 0 || a.sign() == 0 {
+		return c
+	}
+	if a.neg {
+		return -compareAbs(a, b)
+	}
+	return compareAbs(a, b)
+}
+
+func (n Number) sign() int {
+	switch {
+	case n.digits == "":
+		return 0
+	case n.neg:
+		return -1
+	}
+	return 1
+}
+
+// compareAbs compares the absolute values of nonzero numbers:
+// a number with a bigger exponent is bigger, numbers with equal exponents are compared digit by digit.
+func compareAbs(a, b Number) int {
+	if a.exp != b.exp {
+		if a.exp < b.exp {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.digits, b.digits)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
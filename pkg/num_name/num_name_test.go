@@ -0,0 +1,107 @@
+package num_name
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	type TestCase struct {
+		A, B     string
+		Expected int
+	}
+
+	tcs := []TestCase{
+		{A: "5", B: "6", Expected: -1},
+		{A: "0005", B: "6", Expected: -1},
+		{A: "10", B: "0009", Expected: 1},
+		{A: "-0", B: "0", Expected: 0},
+		{A: "-000", B: "00", Expected: 0},
+		{A: "-5", B: "-0", Expected: -1},
+		{A: "-6000", B: "-5999", Expected: -1},
+		{A: "-12345678901011121314151617181920", B: "12345678901011121314151617181919", Expected: -1},
+		{A: "12345678901011121314151617181920", B: "12345678901011121314151617181919", Expected: 1},
+		{A: "-12345678901011121314151617181920", B: "-12345678901011121314151617181919", Expected: -1},
+	}
+
+	for _, tc := range tcs {
+		a, err := Parse(tc.A)
+		assert.NoError(t, err)
+		b, err := Parse(tc.B)
+		assert.NoError(t, err)
+
+		assert.Equal(t, tc.Expected, Compare(a, b), "%s vs %s", tc.A, tc.B)
+		assert.Equal(t, -tc.Expected, Compare(b, a), "%s vs %s", tc.B, tc.A)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"", "-", "--1", "1-", "1.5", "a"} {
+		_, err := Parse(s)
+		assert.ErrorIs(t, err, ErrNotNumber, s)
+	}
+
+	n, err := Parse("-000")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", n.String())
+
+	n, err = Parse("-0012")
+	assert.NoError(t, err)
+	assert.Equal(t, "-12", n.String())
+}
+
+func TestCompareDecimal(t *testing.T) {
+	type TestCase struct {
+		A, B     string
+		Expected int
+	}
+
+	tcs := []TestCase{
+		{A: "3.14", B: "3.141", Expected: -1},
+		{A: "3.14", B: "3.140", Expected: 0},
+		{A: "-2.5", B: "-2", Expected: -1},
+		{A: "-2.5", B: "0", Expected: -1},
+		{A: "1e6", B: "999999.9999999999999999", Expected: 1},
+		{A: "1e6", B: "1000000", Expected: 0},
+		{A: "1.5E-3", B: "0.0015", Expected: 0},
+		{A: "1e-3", B: "0", Expected: 1},
+		{A: "-0.0", B: "0e10", Expected: 0},
+		{A: "12345678901011121314151617181920.5", B: "12345678901011121314151617181920", Expected: 1},
+		{A: "1e1000000000", B: "9e999999999", Expected: 1},
+		{A: "-1e1000000000", B: "-9e999999999", Expected: -1},
+	}
+
+	for _, tc := range tcs {
+		a, err := ParseDecimal(tc.A)
+		assert.NoError(t, err)
+		b, err := ParseDecimal(tc.B)
+		assert.NoError(t, err)
+
+		assert.Equal(t, tc.Expected, Compare(a, b), "%s vs %s", tc.A, tc.B)
+		assert.Equal(t, -tc.Expected, Compare(b, a), "%s vs %s", tc.B, tc.A)
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	for _, s := range []string{"", ".5", "5.", "1e", "1e+", "e5", "1.2.3", "1e5.5", "--1", "1e--5"} {
+		_, err := ParseDecimal(s)
+		assert.ErrorIs(t, err, ErrNotNumber, s)
+	}
+
+	_, err := ParseDecimal("1e99999999999999999999")
+	assert.ErrorIs(t, err, ErrExponentRange)
+
+	for s, expected := range map[string]string{
+		"3.140":   "3.14",
+		"-002.50": "-2.5",
+		"1e6":     "1000000",
+		"1.5E-3":  "0.0015",
+		"1e100":   "1e100",
+		"-0.0":    "0",
+	} {
+		n, err := ParseDecimal(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n.String(), s)
+	}
+}